@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Manifests are stored in the CacheAC namespace as ActionResult messages, from
+// the Bazel Remote Execution API
+// (build/bazel/remote/execution/v2/remote_execution.proto), so that they're
+// accepted by servers that validate them, like bazel-remote. Only the fields
+// that walk uses are encoded, which is simple enough to do by hand:
+//
+//	message ActionResult {
+//	  repeated OutputFile output_files = 2;
+//	}
+//
+//	message OutputFile {
+//	  string path = 1;
+//	  Digest digest = 2;
+//	  bool is_executable = 4;
+//	}
+//
+//	message Digest {
+//	  string hash = 1;
+//	  int64 size_bytes = 2;
+//	}
+const (
+	actionResultOutputFiles = 2
+
+	outputFilePath         = 1
+	outputFileDigest       = 2
+	outputFileIsExecutable = 4
+
+	digestHash      = 1
+	digestSizeBytes = 2
+)
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// errMalformedMessage is returned when a protobuf message can't be decoded.
+var errMalformedMessage = errors.New("malformed protobuf message")
+
+// MarshalBinary encodes the manifest as an ActionResult message.
+func (m *outputManifest) MarshalBinary() ([]byte, error) {
+	var b []byte
+	for _, e := range m.Outputs {
+		var digest []byte
+		digest = appendBytesField(digest, digestHash, []byte(e.Hash))
+		if e.Size != 0 {
+			digest = appendVarintField(digest, digestSizeBytes, uint64(e.Size))
+		}
+
+		var file []byte
+		file = appendBytesField(file, outputFilePath, []byte(e.Path))
+		file = appendBytesField(file, outputFileDigest, digest)
+		if e.Executable {
+			file = appendVarintField(file, outputFileIsExecutable, 1)
+		}
+
+		b = appendBytesField(b, actionResultOutputFiles, file)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes an ActionResult message into the manifest. Fields
+// that walk doesn't use are skipped.
+func (m *outputManifest) UnmarshalBinary(b []byte) error {
+	return decodeFields(b, func(field, wire int, _ uint64, data []byte) error {
+		if field != actionResultOutputFiles || wire != wireBytes {
+			return nil
+		}
+
+		var e outputEntry
+		err := decodeFields(data, func(field, wire int, v uint64, data []byte) error {
+			switch {
+			case field == outputFilePath && wire == wireBytes:
+				e.Path = string(data)
+			case field == outputFileIsExecutable && wire == wireVarint:
+				e.Executable = v != 0
+			case field == outputFileDigest && wire == wireBytes:
+				return decodeFields(data, func(field, wire int, v uint64, data []byte) error {
+					switch {
+					case field == digestHash && wire == wireBytes:
+						e.Hash = string(data)
+					case field == digestSizeBytes && wire == wireVarint:
+						e.Size = int64(v)
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		m.Outputs = append(m.Outputs, e)
+		return nil
+	})
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// decodeFields calls fn with each field in the encoded message. For varint
+// fields, v is the value, and for length delimited fields, data is the value.
+func decodeFields(b []byte, fn func(field, wire int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errMalformedMessage
+		}
+		b = b[n:]
+
+		var (
+			v    uint64
+			data []byte
+		)
+		field, wire := int(tag>>3), int(tag&7)
+		switch wire {
+		case wireVarint:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return errMalformedMessage
+			}
+		case wireBytes:
+			l, m := binary.Uvarint(b)
+			if m <= 0 || l > uint64(len(b)-m) {
+				return errMalformedMessage
+			}
+			data, n = b[m:m+int(l)], m+int(l)
+		case wireFixed64:
+			n = 8
+		case wireFixed32:
+			n = 4
+		default:
+			return errMalformedMessage
+		}
+		if n > len(b) {
+			return errMalformedMessage
+		}
+		b = b[n:]
+
+		if err := fn(field, wire, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// These are the namespaces within a Cache.
+const (
+	// CacheCAS is the namespace for blobs, which are keyed by the hash of
+	// their contents.
+	CacheCAS = "cas"
+
+	// CacheAC is the namespace for manifests, which are keyed by the action
+	// key of a target.
+	CacheAC = "ac"
+)
+
+// EnvCacheDir is the name of the environment variable that can be used to
+// change the directory that the local output cache is stored in.
+const EnvCacheDir = "WALK_CACHE_DIR"
+
+// EnvRemoteCache is the name of the environment variable that can be used to
+// provide the URL of a remote cache server.
+const EnvRemoteCache = "WALK_REMOTE_CACHE"
+
+// ErrCacheMiss is returned by a Cache when the key does not exist.
+var ErrCacheMiss = errors.New("cache miss")
+
+// errCorruptBlob is returned when reading a blob from the CacheCAS namespace,
+// whose contents don't match its key.
+var errCorruptBlob = errors.New("contents of blob do not match its hash")
+
+// Cache is a key/value store for the outputs of targets.
+type Cache interface {
+	// Get returns the value of the key, in the given namespace. If the key
+	// does not exist, ErrCacheMiss is returned.
+	Get(ns, key string) (io.ReadCloser, error)
+
+	// Put stores the value of the key, in the given namespace.
+	Put(ns, key string, r io.Reader) error
+}
+
+// NewDirCache returns a Cache implementation that's backed by a directory.
+func NewDirCache(dir string) Cache {
+	return &dirCache{dir: dir}
+}
+
+// dirCache is a Cache implementation that stores each key as a file within a
+// directory.
+type dirCache struct {
+	dir string
+}
+
+// Get implements the Cache interface.
+func (c *dirCache) Get(ns, key string) (io.ReadCloser, error) {
+	f, err := os.Open(c.path(ns, key))
+	if os.IsNotExist(err) {
+		return nil, ErrCacheMiss
+	}
+	return f, err
+}
+
+// Put implements the Cache interface.
+func (c *dirCache) Put(ns, key string, r io.Reader) error {
+	path := c.path(ns, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, r, 0644)
+}
+
+func (c *dirCache) path(ns, key string) string {
+	return filepath.Join(c.dir, ns, key)
+}
+
+// writeFileAtomic writes the contents of r to a temporary file, which is then
+// renamed to path, so that readers never observe a partially written file.
+func writeFileAtomic(path string, r io.Reader, mode os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// NewTieredCache returns a Cache implementation that reads from each of the
+// given caches in order, and writes to all of them. When a key is found in any
+// cache but the first, it's copied to the first cache.
+func NewTieredCache(caches ...Cache) Cache {
+	return tieredCache(caches)
+}
+
+// tieredCache is a Cache implementation that composes multiple caches, like a
+// local and a remote cache.
+type tieredCache []Cache
+
+// Get implements the Cache interface.
+func (c tieredCache) Get(ns, key string) (io.ReadCloser, error) {
+	for i, cache := range c {
+		r, err := cache.Get(ns, key)
+		if err == ErrCacheMiss {
+			continue
+		}
+		if err != nil || i == 0 {
+			return r, err
+		}
+
+		// If the value can't be copied (e.g. the connection to a remote
+		// cache was interrupted, or the blob is corrupt), it's treated as
+		// a miss.
+		if ns == CacheCAS {
+			r = verifyBlob(r, key)
+		}
+		err = c[0].Put(ns, key, r)
+		r.Close()
+		if err != nil {
+			return nil, ErrCacheMiss
+		}
+		return c[0].Get(ns, key)
+	}
+	return nil, ErrCacheMiss
+}
+
+// Put implements the Cache interface. The value is written to the first
+// cache, and then copied from there to the others.
+func (c tieredCache) Put(ns, key string, r io.Reader) error {
+	if len(c) == 0 {
+		return nil
+	}
+
+	if err := c[0].Put(ns, key, r); err != nil {
+		return err
+	}
+
+	for _, cache := range c[1:] {
+		r, err := c[0].Get(ns, key)
+		if err != nil {
+			return err
+		}
+		err = cache.Put(ns, key, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyBlob returns a reader that returns errCorruptBlob at the end of r, if
+// the sha256 of its contents doesn't match key. Since files are only renamed
+// into place once they've been written completely (see writeFileAtomic), a
+// corrupt blob is never stored, or restored.
+func verifyBlob(r io.ReadCloser, key string) io.ReadCloser {
+	return &blobVerifier{ReadCloser: r, key: key, h: sha256.New()}
+}
+
+type blobVerifier struct {
+	io.ReadCloser
+	key string
+	h   hash.Hash
+}
+
+func (r *blobVerifier) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(r.h.Sum(nil)) != r.key {
+		return n, errCorruptBlob
+	}
+	return n, err
+}
+
+// NewHTTPCache returns a Cache implementation that's backed by an HTTP server.
+// Values are read with GET, and written with PUT, to /<ns>/<key> relative to
+// url, which is compatible with the layout of bazel-remote.
+//
+// The remote cache is treated as an optimization; if the server is
+// unreachable, or returns an error, a warning is printed to w and the cache is
+// treated as a miss from then on.
+func NewHTTPCache(url string, readOnly bool, w io.Writer) Cache {
+	return &httpCache{
+		url:      strings.TrimSuffix(url, "/"),
+		readOnly: readOnly,
+		client:   &http.Client{Timeout: 60 * time.Second},
+		w:        w,
+	}
+}
+
+// httpCache is a Cache implementation that speaks to an HTTP server.
+type httpCache struct {
+	url      string
+	readOnly bool
+	client   *http.Client
+
+	// Warnings are written here.
+	w io.Writer
+
+	mu sync.Mutex
+
+	// Set after a failed read or write, so that a broken server is only
+	// reported once.
+	noRead, noWrite bool
+}
+
+// Get implements the Cache interface.
+func (c *httpCache) Get(ns, key string) (io.ReadCloser, error) {
+	if c.disabled(&c.noRead) {
+		return nil, ErrCacheMiss
+	}
+
+	resp, err := c.client.Get(c.path(ns, key))
+	if err != nil {
+		c.disable(&c.noRead, "read from", err)
+		return nil, ErrCacheMiss
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrCacheMiss
+	default:
+		resp.Body.Close()
+		c.disable(&c.noRead, "read from", fmt.Errorf("unexpected status: %s", resp.Status))
+		return nil, ErrCacheMiss
+	}
+}
+
+// Put implements the Cache interface. In read only mode, this is a noop.
+func (c *httpCache) Put(ns, key string, r io.Reader) error {
+	if c.readOnly || c.disabled(&c.noWrite) {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodPut, c.path(ns, key), r)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.disable(&c.noWrite, "write to", err)
+		return nil
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		c.disable(&c.noWrite, "write to", fmt.Errorf("unexpected status: %s", resp.Status))
+	}
+	return nil
+}
+
+func (c *httpCache) path(ns, key string) string {
+	return fmt.Sprintf("%s/%s/%s", c.url, ns, key)
+}
+
+func (c *httpCache) disabled(flag *bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return *flag
+}
+
+func (c *httpCache) disable(flag *bool, op string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if *flag {
+		return
+	}
+	*flag = true
+	fmt.Fprintf(c.w, "%s\n", ansi("33", "warning: unable to %s remote cache, continuing without it: %v", op, err))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPCache(t *testing.T) {
+	s := httptest.NewServer(&cacheHandler{
+		cache: NewDirCache(t.TempDir()),
+		dir:   t.TempDir(),
+	})
+	defer s.Close()
+
+	b := new(bytes.Buffer)
+	c := NewHTTPCache(s.URL, false, b)
+
+	blob := "hello"
+	key := hashBytes([]byte(blob))
+
+	_, err := c.Get(CacheCAS, key)
+	assert.Equal(t, ErrCacheMiss, err)
+
+	err = c.Put(CacheCAS, key, strings.NewReader(blob))
+	assert.NoError(t, err)
+	assert.Equal(t, blob, get(t, c, CacheCAS, key))
+
+	// Blobs must match their key.
+	resp, err := put(s.URL+"/cas/"+key, "goodbye")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// No warnings.
+	assert.Equal(t, "", b.String())
+}
+
+func TestHTTPCache_ReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	s := httptest.NewServer(&cacheHandler{
+		cache:    NewDirCache(dir),
+		dir:      t.TempDir(),
+		readOnly: true,
+	})
+	defer s.Close()
+
+	key := hashBytes([]byte("hello"))
+	resp, err := put(s.URL+"/cas/"+key, "hello")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Writes from a read only client are discarded, without a warning.
+	b := new(bytes.Buffer)
+	c := NewHTTPCache(s.URL, true, b)
+	err = c.Put(CacheCAS, key, strings.NewReader("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, "", b.String())
+
+	_, err = NewDirCache(dir).Get(CacheCAS, key)
+	assert.Equal(t, ErrCacheMiss, err)
+}
+
+func TestHTTPCache_Unreachable(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	url := s.URL
+	s.Close()
+
+	b := new(bytes.Buffer)
+	c := NewTieredCache(NewDirCache(t.TempDir()), NewHTTPCache(url, false, b))
+
+	key := hashBytes([]byte("hello"))
+	_, err := c.Get(CacheCAS, key)
+	assert.Equal(t, ErrCacheMiss, err)
+
+	err = c.Put(CacheCAS, key, strings.NewReader("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", get(t, c, CacheCAS, key))
+
+	// Each failure is only reported once.
+	_, err = c.Get(CacheCAS, hashBytes([]byte("goodbye")))
+	assert.Equal(t, ErrCacheMiss, err)
+	assert.Equal(t, 2, strings.Count(b.String(), "warning"))
+}
+
+func TestTieredCache(t *testing.T) {
+	local, remote := NewDirCache(t.TempDir()), NewDirCache(t.TempDir())
+	c := NewTieredCache(local, remote)
+
+	key := hashBytes([]byte("hello"))
+	err := remote.Put(CacheCAS, key, strings.NewReader("hello"))
+	assert.NoError(t, err)
+
+	// Found in the remote cache, and copied to the local cache.
+	assert.Equal(t, "hello", get(t, c, CacheCAS, key))
+	assert.Equal(t, "hello", get(t, local, CacheCAS, key))
+
+	// Written to both caches.
+	key = hashBytes([]byte("goodbye"))
+	err = c.Put(CacheCAS, key, strings.NewReader("goodbye"))
+	assert.NoError(t, err)
+	assert.Equal(t, "goodbye", get(t, local, CacheCAS, key))
+	assert.Equal(t, "goodbye", get(t, remote, CacheCAS, key))
+}
+
+func TestTieredCache_CorruptBlob(t *testing.T) {
+	local, remote := NewDirCache(t.TempDir()), NewDirCache(t.TempDir())
+	c := NewTieredCache(local, remote)
+
+	key := hashBytes([]byte("hello"))
+	err := remote.Put(CacheCAS, key, strings.NewReader("goodbye"))
+	assert.NoError(t, err)
+
+	// Not copied to the local cache.
+	_, err = c.Get(CacheCAS, key)
+	assert.Equal(t, ErrCacheMiss, err)
+	_, err = local.Get(CacheCAS, key)
+	assert.Equal(t, ErrCacheMiss, err)
+}
+
+func TestOutputManifest(t *testing.T) {
+	m := &outputManifest{Outputs: []outputEntry{
+		{Path: "out.txt", Hash: "ab", Size: 3, Executable: true},
+	}}
+
+	raw, err := m.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("\x12\x13\x0a\x07out.txt\x12\x06\x0a\x02ab\x10\x03\x20\x01"), raw)
+
+	// Fields that walk doesn't use (e.g. exit_code) are skipped.
+	raw = append(raw, 0x20, 0x01)
+	decoded := new(outputManifest)
+	assert.NoError(t, decoded.UnmarshalBinary(raw))
+	assert.Equal(t, m, decoded)
+
+	// JSON manifests, written by older versions, can't be decoded.
+	assert.Error(t, new(outputManifest).UnmarshalBinary([]byte(`{"Outputs":[]}`)))
+}
+
+func get(t testing.TB, c Cache, ns, key string) string {
+	r, err := c.Get(ns, key)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer r.Close()
+	raw, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return string(raw)
+}
+
+func put(url, body string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPut, url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
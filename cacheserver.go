@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// CommandCacheServer is the name of the subcommand that runs a reference
+// implementation of a remote cache server.
+const CommandCacheServer = "cache-server"
+
+// Matches valid keys, which are hex encoded sha256 hashes.
+var cacheKeyRegexp = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// cacheServer runs an HTTP server that serves the Cache protocol, backed by a
+// directory.
+func cacheServer(args []string) error {
+	defaultDir := os.Getenv(EnvCacheDir)
+	if defaultDir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		defaultDir = filepath.Join(FindState(wd).Dir, "cache")
+	}
+
+	flags := flag.NewFlagSet(CommandCacheServer, flag.ExitOnError)
+	var (
+		addr     = flags.String("addr", ":8080", "The address to listen on.")
+		dir      = flags.String("dir", defaultDir, "The directory to store the cache in.")
+		readOnly = flags.Bool("read-only", false, "Reject writes to the cache.")
+	)
+	flags.Parse(args)
+
+	fmt.Fprintf(os.Stderr, "serving %s on %s\n", *dir, *addr)
+	return http.ListenAndServe(*addr, &cacheHandler{
+		cache:    NewDirCache(*dir),
+		dir:      *dir,
+		readOnly: *readOnly,
+	})
+}
+
+// cacheHandler is an http.Handler that serves the Cache protocol: GET and PUT
+// requests to /<ns>/<key>.
+type cacheHandler struct {
+	cache Cache
+
+	// Directory where uploads are buffered.
+	dir string
+
+	// If true, PUT requests are rejected.
+	readOnly bool
+}
+
+func (h *cacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ns, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if (ns != CacheAC && ns != CacheCAS) || !cacheKeyRegexp.MatchString(key) {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.get(w, r, ns, key)
+	case http.MethodPut:
+		if h.readOnly {
+			http.Error(w, "cache is read only", http.StatusForbidden)
+			return
+		}
+		h.put(w, r, ns, key)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *cacheHandler) get(w http.ResponseWriter, r *http.Request, ns, key string) {
+	rc, err := h.cache.Get(ns, key)
+	if err == ErrCacheMiss {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if r.Method == http.MethodGet {
+		io.Copy(w, rc)
+	}
+}
+
+// put buffers the request body to a temporary file, so that the contents of
+// blobs in the CacheCAS namespace can be verified against their key before
+// they're stored.
+func (h *cacheHandler) put(w http.ResponseWriter, r *http.Request, ns, key string) {
+	if err := os.MkdirAll(h.dir, 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.CreateTemp(h.dir, ".upload-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	sum := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, sum), r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if ns == CacheCAS && hex.EncodeToString(sum.Sum(nil)) != key {
+		http.Error(w, "content does not match key", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.cache.Put(ns, key, f); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
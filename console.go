@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// maxConsoleBuffer is the number of bytes of output that the console buffers in
+// memory while it's paused. The rest is spilled to a temporary file.
+var maxConsoleBuffer = 1 << 20
+
+// console coordinates access to the terminal, so that interactive targets can
+// be given exclusive access to it, like ninja's console pool. While an
+// interactive target is executing, the output of every other target is
+// buffered, and written once it's done.
+type console struct {
+	// The terminal, which interactive targets are attached to directly.
+	stdin          io.Reader
+	stdout, stderr io.Writer
+
+	// Held by the interactive target that's executing, so that only one
+	// executes at a time.
+	interactive sync.Mutex
+
+	mu sync.Mutex
+
+	// True once a target has declared that it's interactive. Until then,
+	// output isn't routed through the console.
+	enabled bool
+
+	// True while an interactive target is executing.
+	paused bool
+
+	// Writes that were made while paused, and the number of bytes of them
+	// that are held in memory.
+	buffered []bufferedWrite
+	size     int
+
+	// The file that writes are spilled to, once maxConsoleBuffer bytes are
+	// held in memory.
+	spill *os.File
+}
+
+// bufferedWrite is a write that was buffered while the console was paused.
+// Writes that were spilled to a file only record their length.
+type bufferedWrite struct {
+	w io.Writer
+	p []byte
+	n int
+}
+
+func newConsole(stdin io.Reader, stdout, stderr io.Writer) *console {
+	return &console{
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+}
+
+// enable routes the output of targets through the console, which is done once
+// a target declares that it's interactive.
+func (c *console) enable() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enabled = true
+}
+
+// writer returns an io.Writer that writes to w, unless an interactive target
+// is executing, in which case the writes are buffered until it's done. If no
+// target has declared that it's interactive, w is returned as is.
+func (c *console) writer(w io.Writer) io.Writer {
+	if c == nil || w == nil {
+		return w
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.enabled {
+		return w
+	}
+	return &consoleWriter{console: c, w: w}
+}
+
+// acquire waits until no other interactive target is executing, and then
+// pauses the output of all other targets. The returned function resumes it.
+func (c *console) acquire() (release func()) {
+	c.interactive.Lock()
+
+	c.mu.Lock()
+	c.paused = true
+	c.mu.Unlock()
+
+	return func() {
+		c.mu.Lock()
+		c.flush()
+		c.paused = false
+		c.mu.Unlock()
+
+		c.interactive.Unlock()
+	}
+}
+
+// buffer buffers a write to w while the console is paused. Must be called with
+// mu held.
+func (c *console) buffer(w io.Writer, p []byte) {
+	if c.size+len(p) > maxConsoleBuffer && c.spill == nil {
+		// If the file can't be created, everything is kept in memory.
+		c.spill, _ = os.CreateTemp("", "walk-console-")
+	}
+	if c.spill != nil {
+		if _, err := c.spill.Write(p); err == nil {
+			c.buffered = append(c.buffered, bufferedWrite{w: w, n: len(p)})
+			return
+		}
+	}
+	c.buffered = append(c.buffered, bufferedWrite{w: w, p: append([]byte(nil), p...), n: len(p)})
+	c.size += len(p)
+}
+
+// flush writes the writes that were buffered, in order, and removes the spill
+// file. Must be called with mu held.
+func (c *console) flush() {
+	var spilled io.Reader
+	if c.spill != nil {
+		c.spill.Seek(0, io.SeekStart)
+		spilled = c.spill
+		defer os.Remove(c.spill.Name())
+		defer c.spill.Close()
+	}
+
+	for _, b := range c.buffered {
+		if b.p == nil && b.n > 0 {
+			io.CopyN(b.w, spilled, int64(b.n))
+			continue
+		}
+		b.w.Write(b.p)
+	}
+	c.buffered, c.size, c.spill = nil, 0, nil
+}
+
+// consoleWriter is the io.Writer returned by console.writer.
+type consoleWriter struct {
+	console *console
+	w       io.Writer
+}
+
+func (w *consoleWriter) Write(p []byte) (int, error) {
+	c := w.console
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.paused {
+		c.buffer(w.w, p)
+		return len(p), nil
+	}
+	return w.w.Write(p)
+}
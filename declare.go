@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// These are the directives that a Walkfile can write to the file at
+// $WALK_DECLARE, during the deps phase, to declare additional information
+// about the target.
+const (
+	// DeclareInput declares a file that was read to determine the
+	// dependencies of the target (e.g. a source file that was scanned for
+	// includes).
+	DeclareInput = "input"
+
+	// DeclareOutput declares a file that is produced by the exec phase of
+	// the target, which can be stored in, and restored from, the output
+	// cache.
+	DeclareOutput = "output"
+
+	// DeclareEnv declares the name of an environment variable that affects
+	// the output of the target.
+	DeclareEnv = "env"
+
+	// DeclareRetries declares the number of times that the target should
+	// be retried if its exec phase fails.
+	DeclareRetries = "retries"
+
+	// DeclareTimeout declares how long each attempt at executing the exec
+	// phase of the target can take, as a duration like "30s" or "5m".
+	DeclareTimeout = "timeout"
+
+	// DeclarePool declares the name of a pool, and optionally the number of
+	// units of it (defaulting to 1), that the exec phase of the target
+	// uses.
+	DeclarePool = "pool"
+
+	// DeclareInteractive declares that the exec phase of the target
+	// interacts with the user (e.g. prompts for confirmation), so it's
+	// given exclusive access to the terminal.
+	DeclareInteractive = "interactive"
+)
+
+// declarations holds the parsed directives that a Walkfile declared for a
+// target.
+type declarations struct {
+	// Absolute paths to the files that were read to determine the
+	// dependencies of the target.
+	inputs []string
+
+	// Absolute paths to the files that the target produces.
+	outputs []string
+
+	// Names of environment variables that affect the output of the target.
+	env []string
+
+	// The number of times that the target should be retried, if declared.
+	retries *int
+
+	// How long each attempt at executing the target can take. Zero means
+	// that there's no timeout.
+	timeout time.Duration
+
+	// Maps the name of each pool that the target uses to the number of
+	// units that it uses.
+	pools map[string]int
+
+	// True if the target is interactive.
+	interactive bool
+}
+
+// readDeclarations reads the newline delimited directives from r.
+func readDeclarations(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// parseDeclarations parses the given directives. Relative paths are resolved
+// relative to dir.
+func parseDeclarations(dir string, lines []string) (*declarations, error) {
+	d := &declarations{pools: make(map[string]int)}
+	for _, line := range lines {
+		directive, arg, _ := strings.Cut(line, " ")
+		arg = strings.TrimSpace(arg)
+
+		switch directive {
+		case DeclareInput, DeclareOutput:
+			if arg == "" {
+				return d, fmt.Errorf("%s: missing path", directive)
+			}
+			if directive == DeclareInput {
+				d.inputs = append(d.inputs, abs(dir, arg))
+			} else {
+				d.outputs = append(d.outputs, abs(dir, arg))
+			}
+		case DeclareEnv:
+			if arg == "" {
+				return d, fmt.Errorf("%s: missing name", directive)
+			}
+			d.env = append(d.env, arg)
+		case DeclareRetries:
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 0 {
+				return d, fmt.Errorf("%s: invalid number: %q", directive, arg)
+			}
+			d.retries = &n
+		case DeclareTimeout:
+			timeout, err := time.ParseDuration(arg)
+			if err != nil || timeout <= 0 {
+				return d, fmt.Errorf("%s: invalid duration: %q", directive, arg)
+			}
+			d.timeout = timeout
+		case DeclarePool:
+			name, units, err := parsePool(arg)
+			if err != nil {
+				return d, fmt.Errorf("%s: %v", directive, err)
+			}
+			d.pools[name] = units
+		case DeclareInteractive:
+			if arg != "" {
+				return d, fmt.Errorf("%s: unexpected argument: %q", directive, arg)
+			}
+			d.interactive = true
+		default:
+			return d, fmt.Errorf("unknown directive: %q", line)
+		}
+	}
+	return d, nil
+}
+
+// parsePool parses the argument to the pool directive, in the form
+// "<name> [units]".
+func parsePool(arg string) (string, int, error) {
+	fields := strings.Fields(arg)
+	switch len(fields) {
+	case 1:
+		return fields[0], 1, nil
+	case 2:
+		units, err := strconv.Atoi(fields[1])
+		if err != nil || units <= 0 {
+			return "", 0, fmt.Errorf("invalid number of units: %q", fields[1])
+		}
+		return fields[0], units, nil
+	default:
+		return "", 0, fmt.Errorf("expected a name, and optionally a number of units: %q", arg)
+	}
+}
+
+// declared returns the directives that the Walkfile declared for the target,
+// if any.
+func declared(t Target) *declarations {
+	if t, ok := t.(interface{ declared() *declarations }); ok {
+		return t.declared()
+	}
+	return new(declarations)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// depsCacheKind is the kind of document, within the State directory, that
+// cached dependencies are stored as.
+const depsCacheKind = "deps"
+
+// depsCache caches the results of the deps phase of targets within the State
+// directory. Cached results are invalidated when the contents of the Walkfile,
+// any of the inputs that the Walkfile declared, the hermetic environment, or
+// the protocol variables, change.
+type depsCache struct {
+	state *State
+}
+
+// depsEntry is the cached result of the deps phase for a single target.
+type depsEntry struct {
+	// Hash of the Walkfile that was used to determine the dependencies.
+	Walkfile string
+
+	// Maps the absolute path of each declared input to its hash.
+	Inputs map[string]string
+
+	// Absolute paths to the dependencies of the target.
+	Deps []string
+
+	// The raw directives that the Walkfile declared.
+	Declarations []string
+
+	// Hash of the environment that the Walkfile was executed with, in
+	// hermetic mode.
+	Env string `json:",omitempty"`
+
+	// Hash of the protocol variables that the Walkfile was executed with.
+	Protocol string
+}
+
+// protocolHash returns the hash of the protocol variables that are exported to
+// the Walkfile during the deps phase, except for $WALK_PARENTS, which depends
+// on which target found it first, and $WALK_SOCKET, which is only set during
+// the exec phase.
+func protocolHash(ctx context.Context, t *target) string {
+	var env []string
+	for _, v := range t.protocolEnv(ctx) {
+		if !strings.HasPrefix(v, EnvParents+"=") && !strings.HasPrefix(v, EnvSocket+"=") {
+			env = append(env, v)
+		}
+	}
+	return hashBytes([]byte(strings.Join(env, "\n")))
+}
+
+// get returns the cached entry for the target, or nil if there is no entry,
+// or the entry is no longer valid.
+func (c *depsCache) get(ctx context.Context, t *target) (*depsEntry, error) {
+	var e depsEntry
+	ok, err := c.state.read(depsCacheKind, stateKey(t.path), &e)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	walkfile, err := hashFile(t.rulefile)
+	if err != nil {
+		return nil, err
+	}
+	if walkfile != e.Walkfile || envHash(t) != e.Env || protocolHash(ctx, t) != e.Protocol {
+		return nil, nil
+	}
+
+	for path, h := range e.Inputs {
+		current, err := hashFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if current != h {
+			return nil, nil
+		}
+	}
+
+	return &e, nil
+}
+
+// put stores the result of the deps phase for the target. The hashes of the
+// Walkfile and inputs are recorded so that the entry can be invalidated.
+func (c *depsCache) put(ctx context.Context, t *target, deps []string, decls []string, inputs []string) error {
+	walkfile, err := hashFile(t.rulefile)
+	if err != nil {
+		return err
+	}
+
+	e := &depsEntry{
+		Walkfile:     walkfile,
+		Inputs:       make(map[string]string),
+		Deps:         deps,
+		Declarations: decls,
+		Env:          envHash(t),
+		Protocol:     protocolHash(ctx, t),
+	}
+	for _, path := range inputs {
+		h, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		e.Inputs[path] = h
+	}
+
+	return c.state.write(depsCacheKind, stateKey(t.path), e)
+}
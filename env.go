@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// EnvFile is the name of the file, in the root of the project (the directory
+// that contains the state directory), that lists the environment variables
+// that are passed to Walkfiles in hermetic mode, in addition to the defaults.
+// Each line is either the name of a variable, or NAME=value, like the -e flag.
+const EnvFile = ".walkenv"
+
+// hermeticDefaults are the environment variables that are always passed to
+// Walkfiles in hermetic mode, along with the LC_* locale variables.
+var hermeticDefaults = []string{"PATH", "HOME", "TMPDIR", "LANG", "LANGUAGE"}
+
+// EnvVars is a flag.Value that accumulates the environment variables that are
+// passed to Walkfiles in hermetic mode, either as NAME, to pass the value from
+// walk's environment, or as NAME=value.
+type EnvVars []string
+
+// String implements the flag.Value interface.
+func (e *EnvVars) String() string {
+	return strings.Join(*e, ",")
+}
+
+// Set implements the flag.Value interface.
+func (e *EnvVars) Set(v string) error {
+	name, _, _ := strings.Cut(v, "=")
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("invalid environment variable: %q", v)
+	}
+	*e = append(*e, v)
+	return nil
+}
+
+// readEnvFile reads the environment variables that are listed in the file at
+// path. Blank lines, and lines starting with #, are ignored. If the file
+// doesn't exist, nothing is returned.
+func readEnvFile(path string) (EnvVars, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var vars EnvVars
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := vars.Set(line); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return vars, scanner.Err()
+}
+
+// hermeticEnv returns the sorted environment that Walkfiles are executed with
+// in hermetic mode: the defaults and the allowed variables, with their values
+// taken from environ unless they were provided.
+func hermeticEnv(environ []string, allowed EnvVars) []string {
+	values := make(map[string]string)
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		values[name] = value
+	}
+
+	vars := make(map[string]string)
+	for name, value := range values {
+		if strings.HasPrefix(name, "LC_") {
+			vars[name] = value
+		}
+	}
+	for _, name := range hermeticDefaults {
+		if value, ok := values[name]; ok {
+			vars[name] = value
+		}
+	}
+	for _, v := range allowed {
+		name, value, ok := strings.Cut(v, "=")
+		if !ok {
+			value, ok = values[name]
+		}
+		if ok {
+			vars[name] = value
+		}
+	}
+
+	env := make([]string, 0, len(vars))
+	for name, value := range vars {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// managedEnv returns the variables in environ that walk uses to communicate
+// with Walkfiles, and the processes that they execute (e.g. the jobserver in
+// $MAKEFLAGS), which are passed through in hermetic mode. They change between
+// runs, so they aren't part of the hermetic environment's hash.
+func managedEnv(environ []string) []string {
+	var env []string
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		if name == EnvMakeflags || strings.HasPrefix(name, "WALK_") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// envHash returns a hash of the hermetic environment that the target is
+// executed with, or an empty string if walk isn't in hermetic mode.
+func envHash(t Target) string {
+	if t, ok := t.(interface{ environment() []string }); ok && t.environment() != nil {
+		return hashBytes([]byte(strings.Join(t.environment(), "\n")))
+	}
+	return ""
+}
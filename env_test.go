@@ -0,0 +1,48 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvVars_Set(t *testing.T) {
+	var env EnvVars
+	assert.NoError(t, env.Set("FOO"))
+	assert.NoError(t, env.Set("BAR=a=b"))
+	assert.Error(t, env.Set("=value"))
+	assert.Error(t, env.Set("FOO BAR"))
+	assert.Equal(t, EnvVars{"FOO", "BAR=a=b"}, env)
+}
+
+func TestReadEnvFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, EnvFile)
+
+	env, err := readEnvFile(path)
+	assert.NoError(t, err)
+	assert.Nil(t, env)
+
+	writeFile(t, path, "# Credentials\nAWS_PROFILE\n\nGOFLAGS=-mod=mod\n")
+	env, err = readEnvFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, EnvVars{"AWS_PROFILE", "GOFLAGS=-mod=mod"}, env)
+}
+
+func TestHermeticEnv(t *testing.T) {
+	environ := []string{
+		"PATH=/bin",
+		"HOME=/root",
+		"LC_ALL=C",
+		"USER=root",
+		"AWS_PROFILE=dev",
+		"WALK_DECLARE=/dev/null",
+		"MAKEFLAGS=-j2",
+	}
+
+	env := hermeticEnv(environ, EnvVars{"AWS_PROFILE", "GOFLAGS=-mod=mod", "MISSING"})
+	assert.Equal(t, []string{"AWS_PROFILE=dev", "GOFLAGS=-mod=mod", "HOME=/root", "LC_ALL=C", "PATH=/bin"}, env)
+	assert.Equal(t, []string{}, hermeticEnv(nil, nil))
+	assert.Equal(t, []string{"WALK_DECLARE=/dev/null", "MAKEFLAGS=-j2"}, managedEnv(environ))
+}
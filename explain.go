@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// CommandWhy is the name of the subcommand that explains why targets would be
+// executed.
+const CommandWhy = "why"
+
+// reasonForced is the reason that's given for executing a target when there's
+// no Checker, since every target is executed.
+const reasonForced = "forced"
+
+// reasonCached is the reason that's given by dry runs for targets whose
+// outputs would be restored from the OutputCache, instead of being executed.
+const reasonCached = "outputs would be restored from the output cache"
+
+// buildRecordKind is the kind of document, within the State directory, that
+// build records are stored as.
+const buildRecordKind = "builds"
+
+// buildRecord is stored each time that a target is executed.
+type buildRecord struct {
+	// When the target started executing.
+	Time time.Time
+
+	// How long the target took to execute.
+	Duration time.Duration
+
+	// The reason that the target was executed, if it was executed with
+	// Explain.
+	Reason string `json:",omitempty"`
+
+	// If the target failed, the error that it failed with.
+	Error string `json:",omitempty"`
+}
+
+// recordBuild stores a buildRecord for the target in the State directory.
+func (p *Plan) recordBuild(t Target, reason string, start time.Time, err error) error {
+	ft, ok := t.(FileTarget)
+	if !ok || ft.RuleFile() == "" {
+		return nil
+	}
+
+	r := &buildRecord{
+		Time:     start,
+		Duration: time.Since(start),
+	}
+	if p.Explain {
+		r.Reason = reason
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return p.State.write(buildRecordKind, stateKey(ft.Path()), r)
+}
+
+// DryRun prints the targets whose exec phase would be invoked by Exec to w, in
+// the order that they would be executed, without executing them. If a Checker
+// is configured, the reason that each target would be executed is also
+// printed.
+//
+// Since nothing is executed, a target is assumed to be out of date if any of
+// its dependencies would be executed, including dependencies that don't exist
+// on disk, or restored from the OutputCache. Targets whose outputs would be
+// restored from the OutputCache aren't printed.
+func (p *Plan) DryRun(w io.Writer) error {
+	return p.dryRun(func(t Target, reason string) error {
+		if reason == "" || reason == reasonCached {
+			return nil
+		}
+
+		line := t.Name()
+		if p.Checker != nil {
+			line = fmt.Sprintf("%s\t%s", line, reason)
+		}
+		_, err := fmt.Fprintf(w, "%s\n", line)
+		return err
+	})
+}
+
+// Why prints the reason that each of the given targets would be executed by
+// Exec to w, as determined by DryRun, along with when it was last executed, if
+// that was recorded (see RecordBuilds).
+func (p *Plan) Why(w io.Writer, targets ...string) error {
+	reasons := make(map[string]string)
+	if err := p.dryRun(func(t Target, reason string) error {
+		reasons[t.Name()] = reason
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, name := range targets {
+		t := p.graph.Target(name)
+		if t == nil {
+			return fmt.Errorf("unknown target: %s", name)
+		}
+
+		ft, ok := t.(FileTarget)
+		if !ok || ft.RuleFile() == "" {
+			fmt.Fprintf(w, "%s: static file, never executed\n", name)
+			continue
+		}
+
+		reason := reasons[name]
+		if reason == "" {
+			reason = "up to date"
+		}
+		fmt.Fprintf(w, "%s: %s\n", name, reason)
+
+		if p.State == nil {
+			continue
+		}
+
+		var r buildRecord
+		ok, err := p.State.read(buildRecordKind, stateKey(ft.Path()), &r)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Fprintf(w, "  no recorded execution\n")
+			continue
+		}
+
+		status := StatusOK
+		if r.Error != "" {
+			status = fmt.Sprintf("%s: %s", StatusError, r.Error)
+		}
+		line := fmt.Sprintf("  last executed at %s, took %s (%s)", formatTime(r.Time), r.Duration.Round(time.Millisecond), status)
+		if r.Reason != "" {
+			line = fmt.Sprintf("%s, because: %s", line, r.Reason)
+		}
+		fmt.Fprintf(w, "%s\n", line)
+	}
+
+	return nil
+}
+
+// dryRun determines the reason that each target in the graph would be executed
+// by Exec, calling fn with each target, in the order that they would be
+// executed. Static files are skipped. An empty reason indicates that the
+// target is up to date.
+func (p *Plan) dryRun(fn func(Target, string) error) error {
+	// Maps the name of each target that would be executed to the reason
+	// why.
+	reasons := make(map[string]string)
+
+	for _, t := range p.graph.Sorted() {
+		if ft, ok := t.(FileTarget); ok && ft.RuleFile() == "" {
+			continue
+		}
+
+		reason, err := p.reason(t, reasons)
+		if err != nil {
+			return fmt.Errorf("%s: %v", t.Name(), err)
+		}
+		if reason != "" {
+			reasons[t.Name()] = reason
+		}
+
+		if err := fn(t, reason); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reason returns the reason that the target would be executed, given the
+// reasons that the targets before it would be executed. Like run, if the
+// target is out of date, and its outputs are in the OutputCache, reasonCached
+// is returned. The OutputCache is only checked when none of the dependencies
+// would be executed, since their outputs, and so the action key of the target,
+// aren't known until then.
+func (p *Plan) reason(t Target, reasons map[string]string) (string, error) {
+	deps := p.graph.DeclaredDependencies(t)
+
+	// The action keys of targets that don't exist on disk are memoized
+	// for the targets that depend on them, so every target is keyed.
+	var key string
+	if p.OutputCache != nil {
+		var err error
+		if key, err = p.OutputCache.key(t, deps); err != nil {
+			return "", err
+		}
+	}
+
+	changed := ""
+	for _, dep := range deps {
+		reason, ok := reasons[dep.Name()]
+		switch {
+		case !ok:
+		case reason == reasonCached:
+			changed = fmt.Sprintf("dependency %s would be restored from the output cache", dep.Name())
+		default:
+			changed = fmt.Sprintf("dependency %s would be executed", dep.Name())
+		}
+		if changed != "" {
+			break
+		}
+	}
+
+	reason := reasonForced
+	switch {
+	case p.Checker != nil && changed != "":
+		return changed, nil
+	case p.Checker != nil:
+		var err error
+		if reason, err = p.Checker.Check(t, deps); err != nil || reason == "" {
+			return reason, err
+		}
+	}
+
+	if p.OutputCache != nil && changed == "" {
+		cached, err := p.OutputCache.cached(t, key)
+		if err != nil {
+			return "", err
+		}
+		if cached {
+			return reasonCached, nil
+		}
+	}
+
+	return reason, nil
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"container/heap"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/ejholmes/walk/internal/dag"
@@ -13,14 +17,64 @@ import (
 type WalkError struct {
 	mu     sync.Mutex
 	Errors map[string]error
+
+	// Targets that were cancelled, or never started, because another
+	// target failed in fail-fast mode.
+	Cancelled map[string]error
+
+	// Maps targets that were not executed, because one of their
+	// dependencies failed, to the name of the dependency that failed.
+	Skipped map[string]string
+
+	// Maps targets that failed after being retried to the number of
+	// attempts.
+	Attempts map[string]int
+
+	// Maps targets that succeeded after being retried to the number of
+	// attempts.
+	Retried map[string]int
+
+	// Targets that failed because they took longer than their timeout, or
+	// the timeout of the whole run.
+	TimedOut map[string]error
 }
 
 func newWalkError() *WalkError {
-	return &WalkError{Errors: make(map[string]error)}
+	return &WalkError{
+		Errors:    make(map[string]error),
+		Cancelled: make(map[string]error),
+		Skipped:   make(map[string]string),
+		Attempts:  make(map[string]int),
+		Retried:   make(map[string]int),
+		TimedOut:  make(map[string]error),
+	}
 }
 
 func (e *WalkError) Error() string {
-	return fmt.Sprintf("%d %s failed", len(e.Errors), pluralize(len(e.Errors), "target", "targets"))
+	msg := fmt.Sprintf("%d %s failed", len(e.Errors), pluralize(len(e.Errors), "target", "targets"))
+	var details []string
+	if len(e.TimedOut) > 0 {
+		details = append(details, fmt.Sprintf("%d timed out", len(e.TimedOut)))
+	}
+	var retried []string
+	for name, n := range e.Attempts {
+		retried = append(retried, fmt.Sprintf("%s after %d attempts", name, n))
+	}
+	for name, n := range e.Retried {
+		retried = append(retried, fmt.Sprintf("%s succeeded after %d attempts", name, n))
+	}
+	sort.Strings(retried)
+	details = append(details, retried...)
+	if len(details) > 0 {
+		msg = fmt.Sprintf("%s (%s)", msg, strings.Join(details, ", "))
+	}
+	if len(e.Skipped) > 0 {
+		msg = fmt.Sprintf("%s, %d skipped", msg, len(e.Skipped))
+	}
+	if len(e.Cancelled) > 0 {
+		msg = fmt.Sprintf("%s, %d cancelled", msg, len(e.Cancelled))
+	}
+	return msg
 }
 
 func (e *WalkError) Add(t Target, err error) {
@@ -29,7 +83,38 @@ func (e *WalkError) Add(t Target, err error) {
 	}
 	e.mu.Lock()
 	defer e.mu.Unlock()
+	if errors.Is(err, errCancelled) {
+		e.Cancelled[t.Name()] = err
+		return
+	}
 	e.Errors[t.Name()] = err
+
+	var r *retriedError
+	if errors.As(err, &r) {
+		e.Attempts[t.Name()] = r.attempts
+	}
+
+	var timeout *timeoutError
+	if errors.As(err, &timeout) {
+		e.TimedOut[t.Name()] = err
+	}
+}
+
+// skip records that the target was not executed because the given targets
+// failed, and returns the first of them that wasn't cancelled. If all of them
+// were cancelled, the target is also considered cancelled, and nil is
+// returned.
+func (e *WalkError) skip(t Target, failed []Target) Target {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, f := range failed {
+		if _, ok := e.Errors[f.Name()]; ok {
+			e.Skipped[t.Name()] = f.Name()
+			return f
+		}
+	}
+	e.Cancelled[t.Name()] = errCancelled
+	return nil
 }
 
 // Graph wraps a graph of targets.
@@ -37,12 +122,18 @@ type Graph struct {
 	mu  sync.Mutex
 	m   map[string]Target
 	dag *dag.AcyclicGraph
+
+	// Maps the name of each target to the names of the dependencies that
+	// it was connected to, including the ones that TransitiveReduction
+	// removed.
+	declared map[string][]string
 }
 
 func newGraph() *Graph {
 	return &Graph{
-		m:   make(map[string]Target),
-		dag: new(dag.AcyclicGraph),
+		m:        make(map[string]Target),
+		dag:      new(dag.AcyclicGraph),
+		declared: make(map[string][]string),
 	}
 }
 
@@ -64,9 +155,63 @@ func (g *Graph) Add(target Target) Target {
 
 // Connect connects the two targets together.
 func (g *Graph) Connect(target, dependency Target) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, name := range g.declared[target.Name()] {
+		if name == dependency.Name() {
+			return
+		}
+	}
+	g.declared[target.Name()] = append(g.declared[target.Name()], dependency.Name())
 	g.dag.Connect(dag.BasicEdge(target.Name(), dependency.Name()))
 }
 
+// Dependencies returns the direct dependencies of the target.
+func (g *Graph) Dependencies(target Target) []Target {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var deps []Target
+	for _, v := range dag.AsVertexList(g.dag.DownEdges(target.Name())) {
+		deps = append(deps, g.target(v.(string)))
+	}
+	return deps
+}
+
+// DeclaredDependencies returns every dependency that the target was connected
+// to, sorted by name, including the ones that TransitiveReduction removed,
+// because another dependency depends on them. Unlike Dependencies, this is
+// every input that the target's rule declared.
+func (g *Graph) DeclaredDependencies(target Target) []Target {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	names := append([]string(nil), g.declared[target.Name()]...)
+	sort.Strings(names)
+
+	var deps []Target
+	for _, name := range names {
+		deps = append(deps, g.target(name))
+	}
+	return deps
+}
+
+// Dependents returns the targets that directly depend on the target, excluding
+// the root target.
+func (g *Graph) Dependents(target Target) []Target {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var dependents []Target
+	for _, v := range dag.AsVertexList(g.dag.UpEdges(target.Name())) {
+		t := g.target(v.(string))
+		if _, ok := t.(*rootTarget); !ok {
+			dependents = append(dependents, t)
+		}
+	}
+	return dependents
+}
+
 // Target returns the Target with the given name.
 func (g *Graph) Target(name string) Target {
 	g.mu.Lock()
@@ -75,10 +220,46 @@ func (g *Graph) Target(name string) Target {
 	return target
 }
 
-// Walk wraps the underlying Walk function to coerce it to a Target first.
-func (g *Graph) Walk(fn func(Target) error) error {
+// WalkOptions configures Graph.Walk.
+type WalkOptions struct {
+	// The maximum number of targets that are walked at the same time. Zero
+	// means that each target is walked as soon as its dependencies have
+	// been.
+	Workers int
+
+	// If provided, called with each target that's not executed because one
+	// of its dependencies failed, along with the dependency that failed.
+	Skip func(target, failed Target)
+
+	// If provided, targets that are ready to be walked are walked in this
+	// order. It returns true if a should be walked before b.
+	Less func(a, b Target) bool
+}
+
+// Walk wraps the underlying Walk function to coerce it to a Target first. Once
+// ctx is done, targets that haven't been started are recorded as cancelled, and
+// a WalkError is returned after the targets that were started finish.
+func (g *Graph) Walk(ctx context.Context, fn func(Target) error, opts WalkOptions) error {
 	errors := newWalkError()
-	err := g.dag.Walk(func(v dag.Vertex) error {
+
+	// The targets that were either walked or skipped.
+	var mu sync.Mutex
+	visited := make(map[string]bool)
+	visit := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		visited[name] = true
+	}
+
+	var less func(a, b dag.Vertex) bool
+	if opts.Less != nil {
+		less = func(a, b dag.Vertex) bool {
+			return opts.Less(g.Target(a.(string)), g.Target(b.(string)))
+		}
+	}
+
+	err := g.dag.WalkContext(ctx, func(v dag.Vertex) error {
+		visit(v.(string))
 		target := g.Target(v.(string))
 		// We don't actually need to walk the root, since it's a pseudo
 		// target.
@@ -88,15 +269,81 @@ func (g *Graph) Walk(fn func(Target) error) error {
 		err := fn(target)
 		errors.Add(target, err)
 		return err
+	}, dag.WalkOptions{
+		Workers: opts.Workers,
+		Less:    less,
+		Skip: func(v dag.Vertex, vs []dag.Vertex) {
+			visit(v.(string))
+			target := g.Target(v.(string))
+			if _, ok := target.(*rootTarget); ok {
+				return
+			}
+			var failed []Target
+			for _, v := range vs {
+				failed = append(failed, g.Target(v.(string)))
+			}
+			if f := errors.skip(target, failed); f != nil && opts.Skip != nil {
+				opts.Skip(target, f)
+			}
+		},
 	})
 
-	if err == dag.ErrWalk {
+	switch {
+	case err == dag.ErrWalk:
+		return errors
+	case err != nil && err == ctx.Err():
+		for _, v := range g.dag.Vertices() {
+			target := g.Target(v.(string))
+			if _, ok := target.(*rootTarget); ok || visited[v.(string)] {
+				continue
+			}
+			errors.Cancelled[v.(string)] = context.Cause(ctx)
+		}
 		return errors
 	}
 
 	return err
 }
 
+// Sorted returns the targets in the graph in an order that they could be
+// executed in, where each target comes after all of its dependencies. Ties are
+// broken by name, so that the order is stable. The root target is not
+// included.
+func (g *Graph) Sorted() []Target {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Maps each target to the number of its dependencies that have not
+	// been sorted yet.
+	pending := make(map[string]int)
+	ready := new(stringHeap)
+	for _, v := range g.dag.Vertices() {
+		n := g.dag.DownEdges(v).Len()
+		pending[v.(string)] = n
+		if n == 0 {
+			heap.Push(ready, v.(string))
+		}
+	}
+
+	var sorted []Target
+	for ready.Len() > 0 {
+		name := heap.Pop(ready).(string)
+		target := g.target(name)
+		if _, ok := target.(*rootTarget); !ok {
+			sorted = append(sorted, target)
+		}
+
+		for _, v := range dag.AsVertexList(g.dag.UpEdges(name)) {
+			pending[v.(string)]--
+			if pending[v.(string)] == 0 {
+				heap.Push(ready, v.(string))
+			}
+		}
+	}
+
+	return sorted
+}
+
 // TransitiveReduction performs a Transitive reduction of the underlying graph.
 func (g *Graph) TransitiveReduction() {
 	g.dag.TransitiveReduction()
@@ -132,6 +379,21 @@ func (t *rootTarget) Dependencies(_ context.Context) ([]string, error) {
 	return t.deps, nil
 }
 
+// stringHeap implements heap.Interface for a min-heap of strings.
+type stringHeap []string
+
+func (h stringHeap) Len() int            { return len(h) }
+func (h stringHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h stringHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *stringHeap) Push(x interface{}) { *h = append(*h, x.(string)) }
+func (h *stringHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
 func dot(w io.Writer, g *Graph) error {
 	if _, err := io.WriteString(w, "digraph {\n"); err != nil {
 		return err
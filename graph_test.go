@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"sort"
 	"sync"
 	"testing"
@@ -37,16 +38,64 @@ func TestGraph(t *testing.T) {
 	var mu sync.Mutex
 	var targets []string
 
-	g.Walk(func(t Target) error {
+	g.Walk(context.Background(), func(t Target) error {
 		mu.Lock()
 		defer mu.Unlock()
 		targets = append(targets, t.Name())
 		return nil
-	})
+	}, WalkOptions{})
 
 	assert.Equal(t, []string{"a", "b"}, targets)
 }
 
+func TestGraph_DeclaredDependencies(t *testing.T) {
+	g := newGraph()
+	a := &testTarget{name: "a"}
+	b := &testTarget{name: "b"}
+	c := &testTarget{name: "c"}
+	g.Add(a)
+	g.Add(b)
+	g.Add(c)
+	g.Connect(c, b)
+	g.Connect(c, a)
+	g.Connect(b, a)
+	g.TransitiveReduction()
+
+	// c -> a is implied by c -> b -> a, but c still declared it.
+	assert.Equal(t, []Target{b}, g.Dependencies(c))
+	assert.Equal(t, []Target{a, b}, g.DeclaredDependencies(c))
+}
+
+func TestGraph_Walk_Cancel(t *testing.T) {
+	g := newGraph()
+	a := &testTarget{name: "a"}
+	b := &testTarget{name: "b"}
+	c := &testTarget{name: "c"}
+	r := &rootTarget{}
+	g.Add(a)
+	g.Add(b)
+	g.Add(c)
+	g.Add(r)
+	g.Connect(b, a)
+	g.Connect(c, b)
+	g.Connect(r, c)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	var targets []string
+	err := g.Walk(ctx, func(t Target) error {
+		targets = append(targets, t.Name())
+		cancel(errCancelled)
+		return nil
+	}, WalkOptions{Workers: 1})
+
+	assert.Equal(t, []string{"a"}, targets)
+	var werr *WalkError
+	assert.True(t, errors.As(err, &werr))
+	assert.Equal(t, map[string]error{"b": errCancelled, "c": errCancelled}, werr.Cancelled)
+}
+
 type testTarget struct {
 	name string
 }
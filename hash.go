@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// hashBytes returns the hex encoded sha256 of b.
+func hashBytes(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashFile returns the hex encoded sha256 of the contents of the file at path.
+// Directories are hashed recursively (see hashDir). If the file does not
+// exist, an empty string is returned.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	if fi.IsDir() {
+		return hashDir(path)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashDir returns the hex encoded sha256 of the name, type and hash of each
+// entry in the directory, recursively, so that adding, removing, or changing
+// any file beneath it changes the hash. Symlinks are hashed by their target,
+// rather than followed. State directories are skipped, since walk writes to
+// them on every run.
+func hashDir(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	var lines []string
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		switch {
+		case e.Name() == StateDir:
+			continue
+		case e.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return "", err
+			}
+			lines = append(lines, fmt.Sprintf("symlink %s %s", e.Name(), target))
+		case e.IsDir():
+			h, err := hashDir(path)
+			if err != nil {
+				return "", err
+			}
+			lines = append(lines, fmt.Sprintf("dir %s %s", e.Name(), h))
+		default:
+			h, err := hashFile(path)
+			if err != nil {
+				return "", err
+			}
+			lines = append(lines, fmt.Sprintf("file %s %s", e.Name(), h))
+		}
+	}
+
+	// os.ReadDir returns the entries sorted by name.
+	return hashBytes([]byte(strings.Join(lines, "\n"))), nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashFile_directory(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "src", "lib"), 0755))
+	writeFile(t, filepath.Join(dir, "src", "lib", "a.js"), "a")
+
+	hash := func() string {
+		h, err := hashFile(dir)
+		assert.NoError(t, err)
+		return h
+	}
+
+	before := hash()
+
+	// Editing a file in a subdirectory changes the hash.
+	writeFile(t, filepath.Join(dir, "src", "lib", "a.js"), "b")
+	edited := hash()
+	assert.NotEqual(t, before, edited)
+
+	// So does adding one.
+	writeFile(t, filepath.Join(dir, "src", "lib", "b.js"), "b")
+	added := hash()
+	assert.NotEqual(t, edited, added)
+
+	// The state directory is ignored.
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, StateDir), 0755))
+	writeFile(t, filepath.Join(dir, StateDir, "state.json"), "{}")
+	assert.Equal(t, added, hash())
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// EnvHook is the environment variable that provides the default value of
+// --hook.
+const EnvHook = "WALK_HOOK"
+
+// These are the events that the hook is executed for, which are passed as its
+// first argument.
+const (
+	HookStart  = "start"
+	HookFinish = "finish"
+)
+
+// hookStart executes the hook, if one was provided, before the phase of the
+// target is executed.
+func (t *verboseTarget) hookStart(ctx context.Context, phase string) {
+	t.runHook(ctx, HookStart, t.Name(), phase)
+}
+
+// hookFinish executes the hook, if one was provided, after the phase of the
+// target was executed, with how long it took in milliseconds, and the status
+// that it was reported with.
+func (t *verboseTarget) hookFinish(ctx context.Context, phase string, d time.Duration, status string) {
+	t.runHook(ctx, HookFinish, t.Name(), phase, fmt.Sprint(d.Milliseconds()), status)
+}
+
+// runHook executes the hook with the given arguments, and the same
+// environment that the Walkfile is executed with. The hook can't fail the
+// target, so if it fails, a warning is printed instead. It's executed even if
+// the target was cancelled. Like their status, it isn't executed for static
+// files.
+//
+// The hook of a target that's executed blocks the target: it's executed while
+// the target holds its slot in the semaphore, so a slow hook delays the targets
+// that are waiting for one. Targets that aren't executed only execute it when
+// they finish, in the background (see report).
+func (t *verboseTarget) runHook(ctx context.Context, args ...string) {
+	if t.hook == "" || t.rulefile == "" {
+		return
+	}
+
+	cmd := exec.CommandContext(context.WithoutCancel(ctx), t.hook, args...)
+	stderr := t.console.writer(t.target.stderr)
+	cmd.Stdout = stderr
+	cmd.Stderr = stderr
+	cmd.Env = append(t.environ(), t.protocolEnv(ctx)...)
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintf(stderr, "%s\n", ansi("33", "warning: %s hook failed: %v", args[0], err))
+	}
+}
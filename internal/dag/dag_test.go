@@ -1,6 +1,7 @@
 package dag
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"strings"
@@ -260,6 +261,42 @@ func TestAcyclicGraphWalk_error(t *testing.T) {
 	t.Fatalf("bad: %#v", visits)
 }
 
+func TestAcyclicGraphWalkContext_skip(t *testing.T) {
+	var g AcyclicGraph
+	g.Add(1)
+	g.Add(2)
+	g.Add(3)
+	g.Add(4)
+	g.Add(5)
+	g.Add(6)
+	g.Connect(BasicEdge(4, 3))
+	g.Connect(BasicEdge(3, 2))
+	g.Connect(BasicEdge(2, 1))
+	g.Connect(BasicEdge(5, 1))
+	g.Connect(BasicEdge(4, 6))
+
+	skipped := make(map[Vertex][]Vertex)
+	var lock sync.Mutex
+	err := g.WalkContext(context.Background(), func(v Vertex) error {
+		if v == 2 || v == 6 {
+			return fmt.Errorf("error")
+		}
+		return nil
+	}, WalkOptions{Skip: func(v Vertex, failed []Vertex) {
+		lock.Lock()
+		defer lock.Unlock()
+		skipped[v] = failed
+	}})
+	if err != ErrWalk {
+		t.Fatalf("err: %v", err)
+	}
+
+	expected := map[Vertex][]Vertex{3: {2}, 4: {2, 6}}
+	if !reflect.DeepEqual(skipped, expected) {
+		t.Fatalf("bad: %#v", skipped)
+	}
+}
+
 const testGraphTransReductionStr = `
 1
   2
@@ -0,0 +1,260 @@
+package dag
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// WalkOptions controls how WalkContext walks the graph.
+type WalkOptions struct {
+	// The maximum number of callbacks that are executed concurrently. Zero
+	// means that each vertex is visited as soon as its dependencies have
+	// been.
+	Workers int
+
+	// Called for each vertex that isn't visited because one or more of its
+	// dependencies failed. May be nil.
+	Skip SkipFunc
+
+	// If provided, vertices that are ready to be visited are visited in
+	// this order, instead of the order that they became ready in. It
+	// returns true if a should be visited before b.
+	Less func(a, b Vertex) bool
+}
+
+// WalkContext walks the graph, calling cb for each vertex after cb has
+// returned for all of its dependencies. Vertices are visited in parallel by a
+// pool of at most opts.Workers goroutines, which take them from a queue of
+// vertices whose dependencies have all been visited, so the walk doesn't need
+// any goroutines or timers for the vertices that are waiting.
+//
+// If any callback returns an error, ErrWalk is returned after the rest of the
+// graph that doesn't depend on it has been walked. If ctx is done, no more
+// vertices are visited, and ctx.Err() is returned once the callbacks that are
+// executing return.
+func (g *AcyclicGraph) WalkContext(ctx context.Context, cb WalkFunc, opts WalkOptions) error {
+	w := &walker{
+		g:       g,
+		ctx:     ctx,
+		cb:      cb,
+		opts:    opts,
+		pending: make(map[interface{}]int),
+		failed:  make(map[interface{}]*Set),
+		done:    make(chan struct{}),
+		ready:   &readyQueue{less: opts.Less},
+	}
+
+	vertices := g.Vertices()
+	for _, v := range vertices {
+		w.pending[hashcode(v)] = 0
+	}
+	for _, v := range vertices {
+		for _, dep := range g.DownEdges(v).List() {
+			if _, ok := w.pending[hashcode(dep)]; ok {
+				w.pending[hashcode(v)]++
+			}
+		}
+	}
+	var ready []Vertex
+	for _, v := range vertices {
+		if w.pending[hashcode(v)] == 0 {
+			ready = append(ready, v)
+		}
+	}
+	w.ready.push(ready)
+	w.remaining = len(vertices)
+
+	w.mu.Lock()
+	w.spawn()
+	if w.workers == 0 {
+		close(w.done)
+	}
+	w.mu.Unlock()
+
+	<-w.done
+
+	switch {
+	case w.remaining > 0 && ctx.Err() != nil:
+		return ctx.Err()
+	case w.remaining > 0:
+		return fmt.Errorf("dag: %d vertices were never visited, because of a cycle", w.remaining)
+	case w.errored:
+		return ErrWalk
+	}
+	return nil
+}
+
+// walker holds the state of a walk.
+type walker struct {
+	g    *AcyclicGraph
+	ctx  context.Context
+	cb   WalkFunc
+	opts WalkOptions
+
+	mu sync.Mutex
+
+	// Maps each vertex to the number of its dependencies that haven't been
+	// visited, or skipped, yet.
+	pending map[interface{}]int
+
+	// Maps each vertex that failed, or was skipped, to the vertices whose
+	// callback returned an error.
+	failed map[interface{}]*Set
+
+	// Vertices whose dependencies have all been visited.
+	ready *readyQueue
+
+	// The number of vertices that haven't been visited, or skipped, yet.
+	remaining int
+
+	// The number of worker goroutines, and how many of them are executing
+	// a callback.
+	workers, running int
+
+	// True if any callback returned an error.
+	errored bool
+
+	// Closed when the last worker exits.
+	done chan struct{}
+}
+
+// spawn starts workers for the vertices that are ready, which no existing
+// worker is about to take. The caller must hold mu.
+func (w *walker) spawn() {
+	for w.ready.Len() > w.workers-w.running && (w.opts.Workers <= 0 || w.workers < w.opts.Workers) {
+		w.workers++
+		go w.work()
+	}
+}
+
+// work visits vertices from the ready queue until it's empty, or the context
+// is done.
+func (w *walker) work() {
+	for {
+		w.mu.Lock()
+		if w.ready.Len() == 0 || w.ctx.Err() != nil {
+			w.workers--
+			if w.workers == 0 {
+				close(w.done)
+			}
+			w.mu.Unlock()
+			return
+		}
+		v := w.ready.pop()
+		w.running++
+		w.mu.Unlock()
+
+		w.finish(v, w.cb(v))
+	}
+}
+
+// skipped is a vertex that wasn't visited because of the failed vertices.
+type skipped struct {
+	v      Vertex
+	failed []Vertex
+}
+
+// finish marks v as visited, and queues the vertices that depend on it, if
+// their dependencies have all been visited. Vertices that depend on a vertex
+// that failed are skipped, along with the vertices that depend on them.
+func (w *walker) finish(v Vertex, err error) {
+	w.mu.Lock()
+	w.running--
+	w.remaining--
+	if err != nil {
+		w.failed[hashcode(v)] = new(Set)
+		w.failed[hashcode(v)].Add(v)
+		w.errored = true
+	}
+
+	var skips []skipped
+	var ready []Vertex
+	for queue := []Vertex{v}; len(queue) > 0; queue = queue[1:] {
+		v := queue[0]
+		failed := w.failed[hashcode(v)]
+		for _, dependent := range w.g.UpEdges(v).List() {
+			h := hashcode(dependent)
+			if _, ok := w.pending[h]; !ok {
+				continue
+			}
+			if failed != nil {
+				if w.failed[h] == nil {
+					w.failed[h] = new(Set)
+				}
+				for _, f := range failed.List() {
+					w.failed[h].Add(f)
+				}
+			}
+
+			w.pending[h]--
+			if w.pending[h] > 0 {
+				continue
+			}
+			if w.failed[h] != nil {
+				vs := AsVertexList(w.failed[h])
+				sort.Sort(byVertexName(vs))
+				skips = append(skips, skipped{v: dependent, failed: vs})
+				w.remaining--
+				queue = append(queue, dependent)
+				continue
+			}
+			ready = append(ready, dependent)
+		}
+	}
+	w.ready.push(ready)
+	w.spawn()
+	w.mu.Unlock()
+
+	if w.opts.Skip != nil {
+		for _, s := range skips {
+			w.opts.Skip(s.v, s.failed)
+		}
+	}
+}
+
+// readyQueue holds the vertices that are ready to be visited. Without a less
+// function, vertices are taken in the order that they were pushed, and
+// otherwise it's a heap.
+type readyQueue struct {
+	vs   []Vertex
+	less func(a, b Vertex) bool
+}
+
+// push adds vertices that became ready at the same time. They're sorted by
+// name first, so that the order is stable.
+func (q *readyQueue) push(vs []Vertex) {
+	sort.Sort(byVertexName(vs))
+	for _, v := range vs {
+		if q.less == nil {
+			q.vs = append(q.vs, v)
+			continue
+		}
+		heap.Push(q, v)
+	}
+}
+
+// pop removes the next vertex to visit from the queue.
+func (q *readyQueue) pop() Vertex {
+	if q.less != nil {
+		return heap.Pop(q).(Vertex)
+	}
+	v := q.vs[0]
+	q.vs[0] = nil
+	q.vs = q.vs[1:]
+	return v
+}
+
+func (q *readyQueue) Len() int           { return len(q.vs) }
+func (q *readyQueue) Less(i, j int) bool { return q.less(q.vs[i], q.vs[j]) }
+func (q *readyQueue) Swap(i, j int)      { q.vs[i], q.vs[j] = q.vs[j], q.vs[i] }
+func (q *readyQueue) Push(x interface{}) { q.vs = append(q.vs, x) }
+func (q *readyQueue) Pop() interface{} {
+	n := len(q.vs)
+	x := q.vs[n-1]
+	q.vs[n-1] = nil
+	q.vs = q.vs[:n-1]
+	return x
+}
@@ -0,0 +1,257 @@
+package dag
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAcyclicGraphWalkContext_workers(t *testing.T) {
+	var g AcyclicGraph
+	g.Add(0)
+	for i := 1; i <= 20; i++ {
+		g.Add(i)
+		g.Connect(BasicEdge(0, i))
+	}
+
+	var running, max int32
+	err := g.WalkContext(context.Background(), func(v Vertex) error {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		return nil
+	}, WalkOptions{Workers: 3})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if max != 3 {
+		t.Fatalf("bad: %d", max)
+	}
+}
+
+func TestAcyclicGraphWalkContext_less(t *testing.T) {
+	var g AcyclicGraph
+	g.Add(0)
+	for i := 1; i <= 5; i++ {
+		g.Add(i)
+		g.Connect(BasicEdge(0, i))
+	}
+
+	var visits []Vertex
+	err := g.WalkContext(context.Background(), func(v Vertex) error {
+		visits = append(visits, v)
+		return nil
+	}, WalkOptions{
+		Workers: 1,
+		Less: func(a, b Vertex) bool {
+			return a.(int) > b.(int)
+		},
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []Vertex{5, 4, 3, 2, 1, 0}
+	if !reflect.DeepEqual(visits, expected) {
+		t.Fatalf("bad: %#v", visits)
+	}
+}
+
+func TestAcyclicGraphWalkContext_cancel(t *testing.T) {
+	var g AcyclicGraph
+	g.Add(1)
+	g.Add(2)
+	g.Add(3)
+	g.Connect(BasicEdge(3, 2))
+	g.Connect(BasicEdge(2, 1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var visits []Vertex
+	var lock sync.Mutex
+	err := g.WalkContext(ctx, func(v Vertex) error {
+		lock.Lock()
+		defer lock.Unlock()
+		visits = append(visits, v)
+		if v == 2 {
+			cancel()
+		}
+		return nil
+	}, WalkOptions{})
+	if err != context.Canceled {
+		t.Fatalf("err: %v", err)
+	}
+
+	if len(visits) != 2 {
+		t.Fatalf("bad: %#v", visits)
+	}
+}
+
+func TestAcyclicGraphWalkContext_cycle(t *testing.T) {
+	var g AcyclicGraph
+	g.Add(1)
+	g.Add(2)
+	g.Add(3)
+	g.Connect(BasicEdge(3, 2))
+	g.Connect(BasicEdge(2, 1))
+	g.Connect(BasicEdge(1, 2))
+
+	err := g.WalkContext(context.Background(), func(v Vertex) error {
+		return nil
+	}, WalkOptions{})
+	if err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func BenchmarkAcyclicGraphWalk_10k(b *testing.B) {
+	benchmarkAcyclicGraphWalk(b, 10000)
+}
+
+func BenchmarkAcyclicGraphWalk_100k(b *testing.B) {
+	benchmarkAcyclicGraphWalk(b, 100000)
+}
+
+// benchmarkAcyclicGraphWalk walks a graph of n vertices, in layers of 100,
+// where each vertex depends on 3 vertices in the layer below it.
+func benchmarkAcyclicGraphWalk(b *testing.B, n int) {
+	const width = 100
+
+	var g AcyclicGraph
+	for i := 0; i < n; i++ {
+		g.Add(i)
+		if i < width {
+			continue
+		}
+		layer := i/width*width - width
+		for j := 0; j < 3; j++ {
+			g.Connect(BasicEdge(i, layer+(i+j)%width))
+		}
+	}
+
+	cb := func(v Vertex) error {
+		return nil
+	}
+	walks := []struct {
+		name string
+		walk func() error
+	}{
+		{"walker", func() error { return g.WalkContext(context.Background(), cb, WalkOptions{Workers: 8}) }},
+		{"polling", func() error { return g.pollingWalk(cb) }},
+	}
+	for _, w := range walks {
+		b.Run(w.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := w.walk(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*n), "ns/vertex")
+		})
+	}
+}
+
+// pollingWalk is the walk that WalkContext replaced, which is kept so that
+// the benchmarks can compare against it. Each vertex gets two goroutines, one
+// of which polls the channels of its dependencies until they're closed.
+func (g *AcyclicGraph) pollingWalk(cb WalkFunc) error {
+	// Cache the vertices since we use it multiple times
+	vertices := g.Vertices()
+
+	// Build the waitgroup that signals when we're done
+	var wg sync.WaitGroup
+	wg.Add(len(vertices))
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		wg.Wait()
+	}()
+
+	// The map of channels to watch to wait for vertices to finish
+	vertMap := make(map[Vertex]chan struct{})
+	for _, v := range vertices {
+		vertMap[v] = make(chan struct{})
+	}
+
+	// The map of whether a vertex errored or not during the walk
+	var errLock sync.Mutex
+	var errored bool
+	errMap := make(map[Vertex]bool)
+	for _, v := range vertices {
+		// Build our list of dependencies and the list of channels to
+		// wait on until we start executing for this vertex.
+		deps := AsVertexList(g.DownEdges(v))
+		depChs := make([]<-chan struct{}, len(deps))
+		for i, dep := range deps {
+			depChs[i] = vertMap[dep]
+		}
+
+		// Get our channel so that we can close it when we're done
+		ourCh := vertMap[v]
+
+		// Start the goroutine to wait for our dependencies
+		readyCh := make(chan bool)
+		go func(v Vertex, deps []Vertex, chs []<-chan struct{}, readyCh chan<- bool) {
+			// First wait for all the dependencies
+			for _, ch := range chs {
+			DepSatisfied:
+				for {
+					select {
+					case <-ch:
+						break DepSatisfied
+					case <-time.After(time.Second * 5):
+					}
+				}
+			}
+
+			// Then, check the map to see if any of our dependencies failed
+			errLock.Lock()
+			defer errLock.Unlock()
+			for _, dep := range deps {
+				if errMap[dep] {
+					errMap[v] = true
+					readyCh <- false
+					return
+				}
+			}
+
+			readyCh <- true
+		}(v, deps, depChs, readyCh)
+
+		// Start the goroutine that executes
+		go func(v Vertex, doneCh chan<- struct{}, readyCh <-chan bool) {
+			defer close(doneCh)
+			defer wg.Done()
+
+			var err error
+			if ready := <-readyCh; ready {
+				err = cb(v)
+			}
+
+			errLock.Lock()
+			defer errLock.Unlock()
+			if err != nil {
+				errMap[v] = true
+				errored = true
+			}
+		}(v, ourCh, readyCh)
+	}
+
+	<-doneCh
+	if errored {
+		return ErrWalk
+	}
+	return nil
+}
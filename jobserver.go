@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvMakeflags is the name of the environment variable that GNU make uses to
+// pass flags, including the location of the jobserver, to sub-makes.
+const EnvMakeflags = "MAKEFLAGS"
+
+// jobserverPollInterval is how long P waits for a token, before checking
+// again.
+var jobserverPollInterval = 100 * time.Millisecond
+
+// jobserver is a Semaphore implementation that draws tokens from a GNU make
+// jobserver, so that the processes that walk executes (e.g. make, cargo, or
+// ninja) share a single pool of slots with walk, and with whatever executed
+// walk.
+//
+// Like make, walk holds one implicit token, so the first slot never needs to
+// be read from the jobserver.
+type jobserver struct {
+	// Tokens are read from, and written back to, this file.
+	f *os.File
+
+	// If walk created the jobserver, the directory that contains it, which
+	// is removed when it's closed.
+	dir string
+
+	// If walk created the jobserver, the number of slots.
+	jobs uint
+
+	// Only one read is in progress at a time, since read deadlines apply
+	// to the whole file.
+	readMu sync.Mutex
+
+	mu sync.Mutex
+
+	// True when the implicit token is in use.
+	implicit bool
+
+	// Tokens that have been read from the jobserver, which must be written
+	// back as is.
+	tokens []byte
+}
+
+// jobserverAuth returns the value of the last --jobserver-auth (or the older
+// --jobserver-fds) flag in makeflags, if any.
+func jobserverAuth(makeflags string) string {
+	var auth string
+	for _, f := range strings.Fields(makeflags) {
+		for _, prefix := range []string{"--jobserver-auth=", "--jobserver-fds="} {
+			if v, ok := strings.CutPrefix(f, prefix); ok {
+				auth = v
+			}
+		}
+	}
+	return auth
+}
+
+// openJobserver connects to the jobserver described by makeflags, as a
+// client. If makeflags doesn't describe a jobserver, nil is returned.
+func openJobserver(makeflags string) (*jobserver, error) {
+	auth := jobserverAuth(makeflags)
+	if auth == "" {
+		return nil, nil
+	}
+
+	// Older versions of make pass the read and write ends of a pipe as
+	// file descriptors, which are opened again so that they can be read
+	// with a deadline.
+	path, ok := strings.CutPrefix(auth, "fifo:")
+	if !ok {
+		r, _, ok := strings.Cut(auth, ",")
+		if !ok {
+			return nil, fmt.Errorf("unsupported jobserver: %q", auth)
+		}
+		path = "/dev/fd/" + r
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open jobserver: %w", err)
+	}
+	return &jobserver{f: f}, nil
+}
+
+// jobserverKey is the context key for the jobserver that walk created, which
+// is shared with the processes that targets execute.
+type jobserverKey struct{}
+
+// withJobserver returns a copy of ctx, where the processes that targets
+// execute share the jobserver.
+func withJobserver(ctx context.Context, s *jobserver) context.Context {
+	return context.WithValue(ctx, jobserverKey{}, s)
+}
+
+// shareJobserver shares the jobserver in ctx, if there is one, with the
+// command, by adding the path to its named pipe to $MAKEFLAGS in the command's
+// environment, like GNU make 4.4.
+func shareJobserver(ctx context.Context, cmd *exec.Cmd) {
+	s, ok := ctx.Value(jobserverKey{}).(*jobserver)
+	if !ok || s.dir == "" {
+		return
+	}
+
+	var makeflags string
+	for _, v := range cmd.Env {
+		if value, ok := strings.CutPrefix(v, EnvMakeflags+"="); ok {
+			makeflags = value
+		}
+	}
+
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", EnvMakeflags, s.makeflags(makeflags)))
+}
+
+// makeflags returns makeflags, with the location of the jobserver added.
+func (s *jobserver) makeflags(makeflags string) string {
+	return strings.TrimSpace(fmt.Sprintf("%s -j%d --jobserver-auth=fifo:%s", makeflags, s.jobs, s.f.Name()))
+}
+
+// P waits until a token is available.
+func (s *jobserver) P() {
+	for !s.acquire(jobserverPollInterval) {
+	}
+}
+
+// TryP acquires a token, if one is immediately available.
+func (s *jobserver) TryP() bool {
+	return s.acquire(0)
+}
+
+// V returns a token to the jobserver.
+func (s *jobserver) V() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.tokens) == 0 {
+		s.implicit = false
+		return
+	}
+
+	token := s.tokens[len(s.tokens)-1]
+	s.tokens = s.tokens[:len(s.tokens)-1]
+	if _, err := s.f.Write([]byte{token}); err != nil {
+		// The token is lost, but there's nothing else that can be
+		// done about it.
+		fmt.Fprintf(os.Stderr, "%s\n", ansi("33", "warning: unable to return token to the jobserver: %v", err))
+	}
+}
+
+// acquire uses the implicit token if it's available, otherwise it waits up to
+// timeout for a token to be read from the jobserver.
+func (s *jobserver) acquire(timeout time.Duration) bool {
+	s.mu.Lock()
+	if !s.implicit {
+		s.implicit = true
+		s.mu.Unlock()
+		return true
+	}
+	s.mu.Unlock()
+
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+
+	token := make([]byte, 1)
+	var err error
+	if timeout == 0 {
+		// An expired deadline fails without attempting the read.
+		err = tryRead(s.f, token)
+	} else if err = s.f.SetReadDeadline(time.Now().Add(timeout)); err == nil {
+		_, err = io.ReadFull(s.f, token)
+	}
+	if err != nil {
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			fmt.Fprintf(os.Stderr, "%s\n", ansi("33", "warning: unable to read token from the jobserver: %v", err))
+		}
+		return false
+	}
+
+	s.mu.Lock()
+	s.tokens = append(s.tokens, token[0])
+	s.mu.Unlock()
+	return true
+}
+
+// Close closes the jobserver, and removes it if walk created it.
+func (s *jobserver) Close() error {
+	err := s.f.Close()
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobserverAuth(t *testing.T) {
+	assert.Equal(t, "", jobserverAuth(""))
+	assert.Equal(t, "", jobserverAuth("-j4 -k"))
+	assert.Equal(t, "fifo:/tmp/fifo", jobserverAuth("-j4 --jobserver-auth=fifo:/tmp/fifo"))
+	assert.Equal(t, "3,4", jobserverAuth("-j --jobserver-fds=3,4 -j"))
+	assert.Equal(t, "5,6", jobserverAuth("--jobserver-fds=3,4 --jobserver-auth=5,6"))
+}
+
+func TestJobserver(t *testing.T) {
+	server, err := newJobserver(2)
+	assert.NoError(t, err)
+	defer server.Close()
+
+	assert.Equal(t, "-k -j2 --jobserver-auth=fifo:"+server.f.Name(), server.makeflags("-k"))
+
+	client, err := openJobserver(server.makeflags("-k"))
+	assert.NoError(t, err)
+	defer client.Close()
+
+	// The server and the client each have an implicit token, and share
+	// the one in the pipe.
+	assert.True(t, server.TryP())
+	assert.True(t, client.TryP())
+	assert.True(t, client.TryP())
+	assert.False(t, server.TryP())
+	assert.False(t, client.TryP())
+
+	client.V()
+	assert.True(t, server.TryP())
+	assert.False(t, client.TryP())
+
+	server.V()
+	server.V()
+	client.V()
+	assert.True(t, client.TryP())
+	assert.True(t, client.TryP())
+
+	// The pipe is removed when the server is closed.
+	client.V()
+	client.V()
+	assert.NoError(t, server.Close())
+	_, err = os.Stat(server.f.Name())
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestShareJobserver(t *testing.T) {
+	server, err := newJobserver(2)
+	assert.NoError(t, err)
+	defer server.Close()
+
+	// The process takes the token from the pipe, and puts it back.
+	cmd := exec.Command("sh", "-c", `echo "$MAKEFLAGS"; fifo=${MAKEFLAGS##*fifo:}; head -c 1 <>"$fifo" >"$fifo"`)
+	cmd.Env = []string{"MAKEFLAGS=-k"}
+	shareJobserver(withJobserver(ctx, server), cmd)
+	out, err := cmd.Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "-k -j2 --jobserver-auth=fifo:"+server.f.Name()+"\n", string(out))
+
+	assert.True(t, server.TryP())
+	assert.True(t, server.TryP())
+	assert.False(t, server.TryP())
+
+	// Without a jobserver, the command is unchanged.
+	cmd = exec.Command("true")
+	shareJobserver(ctx, cmd)
+	assert.Nil(t, cmd.Env)
+}
+
+func TestOpenJobserver_fds(t *testing.T) {
+	// Older versions of make pass a pipe as file descriptors.
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	defer r.Close()
+	defer w.Close()
+	_, err = w.Write([]byte("+"))
+	assert.NoError(t, err)
+
+	client, err := openJobserver(fmt.Sprintf("-j2 --jobserver-fds=%d,%d", r.Fd(), w.Fd()))
+	assert.NoError(t, err)
+	defer client.Close()
+
+	assert.True(t, client.TryP())
+	assert.True(t, client.TryP())
+	assert.False(t, client.TryP())
+	client.V()
+	client.V()
+	assert.True(t, client.TryP())
+	assert.True(t, client.TryP())
+}
+
+func TestOpenJobserver_unsupported(t *testing.T) {
+	_, err := openJobserver("--jobserver-auth=bogus")
+	assert.Error(t, err)
+}
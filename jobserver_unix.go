@@ -0,0 +1,69 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// newJobserver creates a jobserver with the given number of slots, which must
+// be at least 1, as a named pipe, like GNU make 4.4.
+func newJobserver(jobs uint) (*jobserver, error) {
+	dir, err := os.MkdirTemp("", "walk-jobserver-")
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	// Opened for reading and writing, so that opening it doesn't block
+	// waiting for a writer.
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	s := &jobserver{f: f, dir: dir, jobs: jobs}
+
+	// walk holds the implicit token, so there's one less in the pipe.
+	if _, err := f.Write(bytes.Repeat([]byte("+"), int(jobs)-1)); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// tryRead reads len(b) bytes from f, if they're immediately available, and
+// otherwise returns os.ErrDeadlineExceeded.
+func tryRead(f *os.File, b []byte) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var n int
+	var rerr error
+	if err := rc.Read(func(fd uintptr) bool {
+		n, rerr = syscall.Read(int(fd), b)
+		return true
+	}); err != nil {
+		return err
+	}
+	switch {
+	case rerr == syscall.EAGAIN:
+		return os.ErrDeadlineExceeded
+	case rerr != nil:
+		return rerr
+	case n < len(b):
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
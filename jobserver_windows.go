@@ -0,0 +1,19 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// newJobserver is not supported on windows, where GNU make uses named
+// semaphores instead of pipes.
+func newJobserver(jobs uint) (*jobserver, error) {
+	return nil, errors.New("jobserver is not supported on windows")
+}
+
+// tryRead is not supported on windows.
+func tryRead(f *os.File, b []byte) error {
+	return os.ErrDeadlineExceeded
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// execution is the state of a call to Exec, which is shared with the nested
+// walks that join it.
+type execution struct {
+	scheduler *scheduler
+
+	// Cancels the execution, in fail-fast mode.
+	cancel context.CancelCauseFunc
+
+	mu sync.Mutex
+
+	// Maps the key of each target that has started executing to its build,
+	// so that targets that are shared with nested walks are only executed
+	// once.
+	builds map[string]*build
+
+	// Maps the key of each target that holds a slot in the semaphore to the
+	// target.
+	holding map[string]Target
+
+	// Maps the key of each target that has lent its slot in the semaphore
+	// to nested walks to the loan.
+	loans map[string]*loan
+}
+
+func newExecution(scheduler *scheduler, cancel context.CancelCauseFunc) *execution {
+	return &execution{
+		scheduler: scheduler,
+		cancel:    cancel,
+		builds:    make(map[string]*build),
+		holding:   make(map[string]Target),
+		loans:     make(map[string]*loan),
+	}
+}
+
+// build is the result of executing a target.
+type build struct {
+	done chan struct{}
+	err  error
+
+	// The number of attempts that it took to execute the target
+	// successfully, if it was retried.
+	attempts int
+}
+
+// buildKey returns the key that identifies the target within an execution.
+// Targets are identified by their path, since nested walks may name them
+// relative to a different directory.
+func buildKey(t Target) string {
+	if ft, ok := t.(FileTarget); ok {
+		return ft.Path()
+	}
+	return t.Name()
+}
+
+// start returns the build of the target, and true if the caller is
+// responsible for executing it, because it hasn't been started already.
+func (e *execution) start(t Target) (*build, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if b, ok := e.builds[buildKey(t)]; ok {
+		return b, false
+	}
+	b := &build{done: make(chan struct{})}
+	e.builds[buildKey(t)] = b
+	return b, true
+}
+
+// finish records the result of a build that was started.
+func (e *execution) finish(b *build, err error) {
+	b.err = err
+	close(b.done)
+}
+
+// retried records that the target was executed successfully after the given
+// number of attempts.
+func (e *execution) retried(t Target, attempts int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if b, ok := e.builds[buildKey(t)]; ok {
+		b.attempts = attempts
+	}
+}
+
+// attempts returns the number of attempts that it took to execute the target
+// successfully, or 0 if it wasn't retried.
+func (e *execution) attempts(t Target) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if b, ok := e.builds[buildKey(t)]; ok {
+		return b.attempts
+	}
+	return 0
+}
+
+// hold records whether the target holds a slot in the semaphore.
+func (e *execution) hold(t Target, holding bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if holding {
+		e.holding[buildKey(t)] = t
+	} else {
+		delete(e.holding, buildKey(t))
+	}
+}
+
+// holder returns the target with the given key, if it holds a slot in the
+// semaphore.
+func (e *execution) holder(key string) Target {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.holding[key]
+}
+
+// loan is a slot in the semaphore that a target has lent to the nested walks
+// that it executed.
+type loan struct {
+	// Held while the slot is being lent, or returned, so that a nested
+	// walk that starts while the target is reacquiring its slot waits to
+	// borrow it again.
+	mu sync.Mutex
+
+	// The number of nested walks that are borrowing the slot.
+	n int
+}
+
+// lend lends the target's slot in the semaphore to a nested walk, and returns
+// a function that returns it. Nested walks that are executed by the same target
+// at the same time share the loan, so the slot is only released when the first
+// one starts, and reacquired when the last one finishes.
+func (e *execution) lend(t Target) func() {
+	e.mu.Lock()
+	l, ok := e.loans[buildKey(t)]
+	if !ok {
+		l = new(loan)
+		e.loans[buildKey(t)] = l
+	}
+	e.mu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.n++
+	if l.n == 1 {
+		e.scheduler.lend()
+	}
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.n--
+		// The target releases its slot when it's done, so it has to
+		// reacquire it, even if the nested walk was cancelled.
+		if l.n == 0 {
+			e.scheduler.P(context.Background(), t)
+		}
+	}
+}
+
+// socketKey is the context key for the path to the socket that nested walks
+// use to join the execution.
+type socketKey struct{}
+
+// joinRequest is sent by a nested walk to submit targets into the execution
+// of the walk that executed it.
+type joinRequest struct {
+	// Absolute paths to the targets to execute.
+	Targets []string
+
+	// The absolute path to the target whose Walkfile executed the nested
+	// walk, which lends its slot in the semaphore while it waits.
+	Parent string
+}
+
+// joinResponse is sent back to the nested walk once its targets have been
+// executed.
+type joinResponse struct {
+	// The error from executing the targets, if any.
+	Error string
+}
+
+// joinServer listens for nested walks that join an execution.
+type joinServer struct {
+	listener net.Listener
+
+	// The temporary directory that contains the socket.
+	dir string
+
+	wg sync.WaitGroup
+}
+
+// listen starts accepting nested walks, which join the execution, on a unix
+// socket in a temporary directory.
+func (p *Plan) listen(ctx context.Context, e *execution) (*joinServer, error) {
+	dir, err := os.MkdirTemp("", "walk-")
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", filepath.Join(dir, "socket"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	s := &joinServer{listener: l, dir: dir}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				p.serveJoin(ctx, e, conn)
+			}()
+		}
+	}()
+	return s, nil
+}
+
+// path returns the path to the socket.
+func (s *joinServer) path() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops accepting nested walks, and removes the socket. Nested walks
+// can only be executed by targets that are executing, so there are none left
+// by the time that the execution is finished.
+func (s *joinServer) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	os.RemoveAll(s.dir)
+	return err
+}
+
+// serveJoin executes the targets that a nested walk submitted, and sends back
+// the result. If the nested walk exits, its targets are cancelled.
+func (p *Plan) serveJoin(ctx context.Context, e *execution, conn net.Conn) {
+	defer conn.Close()
+
+	var req joinRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		io.Copy(io.Discard, conn)
+		cancel()
+	}()
+
+	var resp joinResponse
+	if err := p.join(ctx, e, req); err != nil {
+		resp.Error = err.Error()
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// join plans the targets that a nested walk submitted, and executes them
+// within the execution. Targets that have already been executed, or are
+// executing, aren't executed again. Only the targets are submitted, so they're
+// planned and executed with this Plan's configuration, and the options that the
+// nested walk was given are ignored.
+func (p *Plan) join(ctx context.Context, e *execution, req joinRequest) error {
+	wd := p.WorkingDir
+	if wd == "" {
+		var err error
+		if wd, err = os.Getwd(); err != nil {
+			return err
+		}
+	}
+
+	var targets []string
+	for _, path := range req.Targets {
+		name, err := filepath.Rel(wd, path)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, name)
+	}
+
+	sub := *p
+	sub.graph = newGraph()
+	if err := sub.Plan(ctx, targets...); err != nil {
+		return err
+	}
+
+	// The target that executed the nested walk can't do anything until
+	// it's done, so its slot is lent to the nested walk's targets, which
+	// also inherit its priority.
+	if parent := e.holder(req.Parent); parent != nil {
+		e.scheduler.inherit(parent, sub.graph.Sorted())
+		defer e.lend(parent)()
+	}
+
+	return sub.walk(ctx, e)
+}
+
+// Join submits the targets, relative to wd, into the execution of the walk
+// that's listening on socket, and waits for them to be executed. The targets
+// are reported by that walk.
+func Join(ctx context.Context, socket, wd string, targets ...string) error {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	req := joinRequest{Parent: os.Getenv(EnvTargetPath)}
+	for _, target := range targets {
+		req.Targets = append(req.Targets, abs(wd, target))
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+
+	var resp joinResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMain runs walk, instead of the tests, when the test binary is executed
+// by a Walkfile as a nested walk.
+func TestMain(m *testing.M) {
+	if os.Getenv("WALK_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestPlan_Join(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  all)
+    case $1 in
+      deps) echo outer; echo shared ;;
+    esac ;;
+  outer)
+    case $1 in
+      exec) WALK_TEST_MAIN=1 "$WALK_TEST_BINARY" inner ;;
+    esac ;;
+  inner)
+    case $1 in
+      deps) echo shared ;;
+      exec) echo inner >> runs ;;
+    esac ;;
+  shared)
+    case $1 in
+      exec) sleep 0.2; echo shared >> runs ;;
+    esac ;;
+  broken)
+    case $1 in
+      exec) WALK_TEST_MAIN=1 "$WALK_TEST_BINARY" fail ;;
+    esac ;;
+  fail)
+    case $1 in
+      exec) exit 1 ;;
+    esac ;;
+esac
+`)
+	bin, err := os.Executable()
+	assert.NoError(t, err)
+	t.Setenv("WALK_TEST_BINARY", bin)
+
+	exec := func(target string) (string, error) {
+		b := new(syncBuffer)
+		plan := newPlan()
+		plan.NewTarget = NewTarget(TargetOptions{
+			WorkingDir: dir,
+			Stdout:     b,
+		})
+		plan.Join = true
+		plan.WorkingDir = dir
+		err := plan.Plan(ctx, target)
+		assert.NoError(t, err)
+		err = plan.Exec(ctx, NewSemaphore(1))
+		return b.String(), err
+	}
+
+	// The nested walk's targets are executed, and reported, by this one.
+	// The shared target is only executed once, and the outer target lends
+	// its slot, or it would deadlock.
+	out, err := exec("all")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(out, "ok\tshared\n"), out)
+	assert.Equal(t, 1, strings.Count(out, "ok\tinner\n"), out)
+	assert.True(t, strings.HasSuffix(out, "ok\touter\nok\tall\n"), out)
+
+	raw, err := os.ReadFile(filepath.Join(dir, "runs"))
+	assert.NoError(t, err)
+	assert.Equal(t, "shared\ninner\n", string(raw))
+
+	// Failures are reported to the nested walk.
+	out, err = exec("broken")
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(out, "error\tfail\texit status 1\n"), out)
+	assert.True(t, strings.Contains(out, "error\tbroken\texit status 1\n"), out)
+}
+
+func TestPlan_Join_Concurrent(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  all)
+    case $1 in
+      deps) echo outer ;;
+    esac ;;
+  outer)
+    case $1 in
+      exec)
+        WALK_TEST_MAIN=1 "$WALK_TEST_BINARY" inner1 &
+        WALK_TEST_MAIN=1 "$WALK_TEST_BINARY" inner2 &
+        wait -n && wait -n ;;
+    esac ;;
+  inner*)
+    case $1 in
+      exec) mkdir running && sleep 0.2 && rmdir running ;;
+    esac ;;
+esac
+`)
+	bin, err := os.Executable()
+	assert.NoError(t, err)
+	t.Setenv("WALK_TEST_BINARY", bin)
+
+	b := new(syncBuffer)
+	plan := newPlan()
+	plan.NewTarget = NewTarget(TargetOptions{
+		WorkingDir: dir,
+		Stdout:     b,
+	})
+	plan.Join = true
+	plan.WorkingDir = dir
+	err = plan.Plan(ctx, "all")
+	assert.NoError(t, err)
+
+	// Both nested walks borrow the outer target's slot, so their targets
+	// are executed one at a time, and the slot is returned once.
+	err = plan.Exec(ctx, NewSemaphore(1))
+	assert.NoError(t, err, b.String())
+	out := b.String()
+	assert.Equal(t, 1, strings.Count(out, "ok\tinner1\n"), out)
+	assert.Equal(t, 1, strings.Count(out, "ok\tinner2\n"), out)
+	assert.True(t, strings.HasSuffix(out, "ok\touter\nok\tall\n"), out)
+}
+
+func TestPlan_Join_Options(t *testing.T) {
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  outer)
+    case $1 in
+      exec) WALK_TEST_MAIN=1 "$WALK_TEST_BINARY" --retries=0 flaky ;;
+    esac ;;
+  flaky)
+    case $1 in
+      exec) [ -e tried ] || { touch tried; exit 1; } ;;
+    esac ;;
+esac
+`)
+	bin, err := os.Executable()
+	assert.NoError(t, err)
+	t.Setenv("WALK_TEST_BINARY", bin)
+
+	b := new(syncBuffer)
+	plan := newPlan()
+	plan.NewTarget = NewTarget(TargetOptions{
+		WorkingDir: dir,
+		Stdout:     b,
+	})
+	plan.Join = true
+	plan.WorkingDir = dir
+	plan.Retries = 1
+	err = plan.Plan(ctx, "outer")
+	assert.NoError(t, err)
+
+	// The nested walk's targets are retried, like the rest of this walk's
+	// targets, even though it was given --retries=0.
+	err = plan.Exec(ctx, NewSemaphore(0))
+	assert.NoError(t, err, b.String())
+	assert.Contains(t, b.String(), "ok\tflaky\tattempt 2/2\n")
+}
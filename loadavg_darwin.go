@@ -0,0 +1,31 @@
+//go:build darwin
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+)
+
+// loadavg returns the 1 minute load average of the system.
+func loadavg() (float64, error) {
+	// struct loadavg { fixpt_t ldavg[3]; long fscale; }
+	raw, err := syscall.Sysctl("vm.loadavg")
+	if err != nil {
+		return 0, err
+	}
+
+	// syscall.Sysctl trims the trailing NUL, which is part of fscale.
+	b := make([]byte, 24)
+	if n := copy(b, raw); n < 20 {
+		return 0, fmt.Errorf("unable to parse vm.loadavg: %q", raw)
+	}
+
+	load := binary.LittleEndian.Uint32(b[0:4])
+	fscale := binary.LittleEndian.Uint64(b[16:24])
+	if fscale == 0 {
+		return 0, fmt.Errorf("unable to parse vm.loadavg: %q", raw)
+	}
+	return float64(load) / float64(fscale), nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"runtime"
+)
+
+// loadavg returns the 1 minute load average of the system.
+func loadavg() (float64, error) {
+	return 0, errors.New("load average is not supported on " + runtime.GOOS)
+}
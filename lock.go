@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LocksDir is the name of the directory within the state directory that
+// contains the lock file of each target.
+const LocksDir = "locks"
+
+// lockPollInterval is how often a lock that's held by another process is
+// tried again.
+var lockPollInterval = 100 * time.Millisecond
+
+// lock takes an exclusive advisory lock on the lock file for the given key, so
+// that walks in other processes don't execute the same target at the same
+// time. If another process holds the lock, waiting is called once, and the
+// lock is tried again until it's acquired, or ctx is done, in which case its
+// cause is returned. The returned function releases the lock, and removes the
+// lock file.
+func (s *State) lock(ctx context.Context, key string, waiting func()) (unlock func(), err error) {
+	path := filepath.Join(s.Dir, LocksDir, stateKey(key)+".lock")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	var waited bool
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		ok, err := tryLock(f)
+		if err == nil && !ok && !waited {
+			waited = true
+			waiting()
+		}
+		for err == nil && !ok {
+			select {
+			case <-ctx.Done():
+				err = context.Cause(ctx)
+			case <-time.After(lockPollInterval):
+				ok, err = tryLock(f)
+			}
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		// The process that held the lock may have removed the lock
+		// file after this one opened it, in which case another process
+		// may have created, and locked, a new one, so this one tries
+		// again.
+		if locked(f, path) {
+			return func() { unlockFile(f, path) }, nil
+		}
+		f.Close()
+	}
+}
+
+// locked returns true if the path still refers to the locked file.
+func locked(f *os.File, path string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	pfi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi, pfi)
+}
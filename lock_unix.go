@@ -0,0 +1,31 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive flock(2) on the file without blocking, and
+// returns false if another process holds it. The lock is released when the
+// file is closed.
+func tryLock(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	if err != nil {
+		return false, os.NewSyscallError("flock", err)
+	}
+	return true, nil
+}
+
+// unlockFile removes the lock file while it's still locked, so that processes
+// that are waiting on it notice that it was removed once they lock it (see
+// locked), and then releases the lock.
+func unlockFile(f *os.File, path string) {
+	os.Remove(path)
+	f.Close()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32       = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx = kernel32.NewProc("LockFileEx")
+)
+
+// Flags for LockFileEx, and the error that it fails with when another process
+// holds the lock.
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// tryLock takes an exclusive lock on the first byte of the file with
+// LockFileEx, without blocking, and returns false if another process holds
+// it. The lock is released when the file is closed.
+func tryLock(f *os.File) (bool, error) {
+	var ol syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r != 0 {
+		return true, nil
+	}
+	if errors.Is(err, errorLockViolation) {
+		return false, nil
+	}
+	return false, os.NewSyscallError("LockFileEx", err)
+}
+
+// unlockFile releases the lock, and then removes the lock file. Files can't be
+// removed on Windows while they're open, so it's left in place when another
+// process is waiting on it.
+func unlockFile(f *os.File, path string) {
+	f.Close()
+	os.Remove(path)
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
 	"github.com/ejholmes/walk/internal/tty"
@@ -31,15 +32,52 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == CommandCacheServer {
+		must(cacheServer(os.Args[2:]))
+		return
+	}
+
+	// `walk why` accepts the same flags as walk, so that the same
+	// conditional execution mode can be explained.
+	args := os.Args[1:]
+	why := len(args) > 0 && args[0] == CommandWhy
+	if why {
+		args = args[1:]
+	}
+
 	flag.Usage = usage
+	pools := NewPools()
+	var env EnvVars
+	flag.Var(&env, "e", fmt.Sprintf("In --hermetic mode, passes an environment variable to the Walkfile, either as NAME, to use the value from walk's environment, or as NAME=value. Can be provided multiple times, in addition to the variables listed in %s.", EnvFile))
+	flag.Var(pools, "pool", "Adds a named pool of slots, in the form name=size (e.g. docker=2), which limits the number of targets that use it concurrently. Targets declare how many units of each pool that they use. Can be provided multiple times.")
 	var (
 		version     = flag.Bool("version", false, "Print the version of walk and exit.")
 		verbose     = flag.Bool("v", false, fmt.Sprintf("Show stdout from the Walkfile when executing the %s phase.", PhaseExec))
 		noprefix    = flag.Bool("noprefix", false, "By default, the stdout/stderr output from the Walkfile is prefixed with the name of the target, followed by a tab character. This flag disables the prefixing. This can help with performance, or issues where you encounter \"too many open files\", since prefixing necessitates more file descriptors.")
 		concurrency = flag.Uint("j", 0, "Controls the number of targets that are executed in parallel. By default, targets are executed with the maximum level of parallelism that the graph allows. To limit the number of targets that are executed in parallel, set this to a value greater than 1. To execute targets serially, set this to 1.")
+		planJobs    = flag.Int("plan-jobs", -1, fmt.Sprintf("Controls the number of %s phases that are executed in parallel while building the graph. By default, this uses the same value as -j.", PhaseDeps))
+		noPlanCache = flag.Bool("no-plan-cache", false, fmt.Sprintf("By default, the results of the %s phase are cached in the %s directory, and reused until the Walkfile, any of the inputs it declared, or its environment change. Walkfiles whose dependencies are computed from anything else (e.g. listing a directory) must declare it as an input. This flag disables the cache.", PhaseDeps, StateDir))
+		noCache     = flag.Bool("no-output-cache", false, fmt.Sprintf("By default, the outputs that targets declare are stored in a cache, and restored instead of executing the target when its inputs haven't changed. This flag disables the cache. The cache is stored in the %s directory, unless $%s is set.", StateDir, EnvCacheDir))
+		remoteCache = flag.String("remote-cache", os.Getenv(EnvRemoteCache), fmt.Sprintf("The URL of a remote cache server, which is used in addition to the local output cache. Defaults to $%s.", EnvRemoteCache))
+		remoteRO    = flag.Bool("remote-cache-read-only", false, "Only read from the remote cache, and never write to it.")
+		hash        = flag.Bool("hash", false, fmt.Sprintf("Only execute targets when the contents of their dependencies, or their Walkfile, have changed since they were last executed. Targets that are up to date are reported as \"%s\". Targets that don't produce a file are always executed.", StatusSkip))
+		mtime       = flag.Bool("m", false, "Only execute targets when the file they produce does not exist, or is older than any of their dependencies, like make(1).")
+		dryRun      = flag.Bool("n", false, fmt.Sprintf("Print the targets whose %s phase would be invoked, in the order that they would be executed, without executing them. When -m or --hash is provided, the reason that each target would be executed is also printed.", PhaseExec))
+		explain     = flag.Bool("explain", false, fmt.Sprintf("Before executing each target, print the reason that it's being executed. When neither -m nor --hash is provided, the reason is \"%s\".", reasonForced))
+		failFast    = flag.Bool("fail-fast", false, fmt.Sprintf("When a target fails, cancel all targets that are executing, and don't execute any more. Interrupted targets are reported as \"%s\".", StatusCancelled))
+		keepGoing   = flag.Bool("k", false, "When a target fails, keep executing targets that don't depend on it. This is the default, and overrides --fail-fast.")
+		retries     = flag.Int("retries", 0, fmt.Sprintf("The number of times to retry a target after its %s phase fails, with an exponential backoff, unless the Walkfile declares otherwise.", PhaseExec))
+		timeout     = flag.Duration("timeout", 0, fmt.Sprintf("If provided, the whole run is cancelled after this amount of time (e.g. 30m), and the targets that are executing are reported as \"%s\".", StatusTimeout))
+		grace       = flag.Duration("grace-period", DefaultGracePeriod, "When targets are cancelled (e.g. by SIGINT, or a timeout), the processes that they started are sent SIGTERM, and then SIGKILL if they haven't exited after this amount of time.")
+		load        = flag.Float64("l", 0, "Don't start new targets while other targets are executing, and the system load average is at least this value, like make(1). By default, there's no limit.")
+		noJobserver = flag.Bool("no-jobserver", false, fmt.Sprintf("By default, when -j is provided, walk acts as a GNU make jobserver, which is shared with the processes that it executes through $%s, and otherwise uses the jobserver that it finds in $%s, if any. This flag disables both.", EnvMakeflags, EnvMakeflags))
+		noJoin      = flag.Bool("no-join", false, fmt.Sprintf("By default, when walk is executed by a Walkfile during the %s phase, it submits its targets to the walk that executed it, which executes them with its own options, and waits for them. This flag disables that, so that the targets are planned and executed independently.", PhaseExec))
+		hermetic    = flag.Bool("hermetic", false, fmt.Sprintf("Execute Walkfiles with a minimal environment (PATH, HOME, TMPDIR, and the locale), plus the variables listed in %s and provided with -e, instead of walk's whole environment. The environment is included in the hashes that determine whether targets are up to date.", EnvFile))
+		hook        = flag.String("hook", os.Getenv(EnvHook), fmt.Sprintf("An executable that's executed with \"%s\", the name of the target, and the phase before each target is executed, and with \"%s\", the name of the target, the phase, the duration in milliseconds, and the status after. Defaults to $%s.", HookStart, HookFinish, EnvHook))
+		watch       = flag.Bool("w", false, fmt.Sprintf("After executing the targets, watch the files that they depend on, and their Walkfiles, for changes. When they change, only the targets whose Walkfile changed execute their %s phase again, and only the targets that depend on the files that changed are executed again. Runs until interrupted.", PhaseDeps))
 		print       = flag.String("p", "", "Prints the underlying DAG to stdout, using the provided format. Available formats are \"dot\" and \"plain\".")
 	)
-	flag.Parse()
+	flag.CommandLine.Parse(args)
 
 	if *version {
 		fmt.Fprintf(os.Stderr, "%s\n", Version)
@@ -51,13 +89,85 @@ func main() {
 		targets = []string{DefaultTarget}
 	}
 
-	plan := newPlan()
-	plan.NewTarget = NewTarget(TargetOptions{
-		Verbose:  *verbose,
-		NoPrefix: *noprefix,
+	if *planJobs < 0 {
+		*planJobs = int(*concurrency)
+	}
+
+	wd, err := os.Getwd()
+	must(err)
+
+	state := FindState(wd)
+
+	if *hermetic {
+		allowed, err := readEnvFile(filepath.Join(state.Root, EnvFile))
+		must(err)
+		env = append(allowed, env...)
+	}
+
+	if *hash && *mtime {
+		must(fmt.Errorf("--hash and -m cannot be used together"))
+	}
+
+	if *watch && (*print != "" || *dryRun || why) {
+		must(fmt.Errorf("-w cannot be used with -p, -n, or %s", CommandWhy))
+	}
+
+	newTarget := NewTarget(TargetOptions{
+		WorkingDir:  wd,
+		Verbose:     *verbose,
+		Jobs:        *concurrency,
+		NoPrefix:    *noprefix,
+		State:       state,
+		PlanCache:   !*noPlanCache,
+		GracePeriod: *grace,
+		Hermetic:    *hermetic,
+		Env:         env,
+		Hook:        *hook,
 	})
 
+	// The Checker and OutputCache memoize the hashes of files, so each plan
+	// gets its own, since files change between executions in watch mode.
+	newExecPlan := func() *Plan {
+		plan := newPlan()
+		plan.NewTarget = newTarget
+		plan.DepsSemaphore = NewSemaphore(uint(*planJobs))
+		plan.State = state
+		plan.Explain = *explain
+		plan.RecordBuilds = true
+		plan.FailFast = *failFast && !*keepGoing
+		plan.Retries = *retries
+		plan.Pools = pools
+		plan.Join = !*noJoin
+		plan.WorkingDir = wd
+		plan.Warnings = os.Stderr
+		if !*noCache {
+			dir := os.Getenv(EnvCacheDir)
+			if dir == "" {
+				dir = filepath.Join(state.Dir, "cache")
+			}
+			cache := NewDirCache(dir)
+			if *remoteCache != "" {
+				cache = NewTieredCache(cache, NewHTTPCache(*remoteCache, *remoteRO, os.Stderr))
+			}
+			plan.OutputCache = NewOutputCache(cache, state.Root)
+		}
+
+		switch {
+		case *hash:
+			plan.Checker = newHashChecker(state)
+		case *mtime:
+			plan.Checker = new(mtimeChecker)
+		}
+		return plan
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = withTimeout(ctx, *timeout)
+		defer cancelTimeout()
+	}
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
@@ -68,6 +178,30 @@ func main() {
 		}
 	}()
 
+	if socket := os.Getenv(EnvSocket); socket != "" && !*noJoin && *print == "" && !why && !*dryRun {
+		must(Join(ctx, socket, wd, targets...))
+		return
+	}
+
+	semaphore := func() (context.Context, Semaphore, func()) {
+		ctx, semaphore, cleanup := jobserverSemaphore(ctx, *concurrency, *noJobserver)
+		if *load > 0 {
+			_, err := loadavg()
+			must(err)
+			semaphore = NewLoadSemaphore(semaphore, *load)
+		}
+		return ctx, semaphore, cleanup
+	}
+
+	if *watch {
+		ctx, semaphore, cleanup := semaphore()
+		err := Watch(ctx, os.Stderr, newExecPlan, semaphore, targets...)
+		cleanup()
+		must(err)
+		return
+	}
+
+	plan := newExecPlan()
 	must(plan.Plan(ctx, targets...))
 	if *print != "" {
 		fn, ok := printGraph[*print]
@@ -75,10 +209,46 @@ func main() {
 			must(fmt.Errorf("invalid format provided: %s", *print))
 		}
 		must(fn(os.Stdout, plan.graph))
+	} else if why {
+		must(plan.Why(os.Stdout, targets...))
+	} else if *dryRun {
+		must(plan.DryRun(os.Stdout))
 	} else {
-		semaphore := NewSemaphore(*concurrency)
-		must(plan.Exec(ctx, semaphore))
+		ctx, semaphore, cleanup := semaphore()
+		err := plan.Exec(ctx, semaphore)
+		cleanup()
+		must(err)
+	}
+}
+
+// jobserverSemaphore returns the Semaphore that limits the number of targets
+// that are executed concurrently, and a function that cleans it up. When -j
+// is provided, walk acts as a GNU make jobserver, which the processes that it
+// executes with the returned context share. Otherwise, if walk was executed by
+// something that provides a jobserver (e.g. make), it uses that.
+func jobserverSemaphore(ctx context.Context, concurrency uint, disabled bool) (context.Context, Semaphore, func()) {
+	noop := func() {}
+	if disabled {
+		return ctx, NewSemaphore(concurrency), noop
+	}
+
+	if concurrency == 0 {
+		s, err := openJobserver(os.Getenv(EnvMakeflags))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", ansi("33", "warning: %v, continuing without it", err))
+		}
+		if s == nil {
+			return ctx, NewSemaphore(0), noop
+		}
+		return ctx, s, func() { s.Close() }
+	}
+
+	s, err := newJobserver(concurrency)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", ansi("33", "warning: unable to create jobserver, continuing without it: %v", err))
+		return ctx, NewSemaphore(concurrency), noop
 	}
+	return withJobserver(ctx, s), s, func() { s.Close() }
 }
 
 func must(err error) {
@@ -104,7 +274,9 @@ func usage() {
 	fmt.Fprintf(os.Stderr, "VERSION:\n")
 	fmt.Fprintf(os.Stderr, "   %s\n\n", Version)
 	fmt.Fprintf(os.Stderr, "USAGE:\n")
-	fmt.Fprintf(os.Stderr, "   walk [target...]\n\n")
+	fmt.Fprintf(os.Stderr, "   walk [target...]\n")
+	fmt.Fprintf(os.Stderr, "   walk %s [target...]\n", CommandWhy)
+	fmt.Fprintf(os.Stderr, "   walk %s [-addr=:8080] [-dir=.walk/cache] [-read-only]\n\n", CommandCacheServer)
 	fmt.Fprintf(os.Stderr, "OPTIONS:\n")
 	flag.PrintDefaults()
 }
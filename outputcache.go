@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// OutputCache stores the outputs that targets declare in a Cache, so that they
+// can be restored instead of executing the target, when the inputs of the
+// target haven't changed.
+//
+// Each target is identified by its action key, which is a hash of the target's
+// name, its Walkfile, the environment variables it declared (or the whole
+// environment, in hermetic mode), the outputs it declared, and the hashes of
+// every dependency that it declared, even those that are also dependencies of
+// another dependency. The contents of each output are stored in the CacheCAS
+// namespace, and a manifest of the outputs is stored in the CacheAC namespace
+// under the action key.
+type OutputCache struct {
+	// The Cache where outputs are stored.
+	Cache Cache
+
+	// Names in action keys are relative to Root, so that they're portable
+	// between checkouts.
+	Root string
+
+	mu sync.Mutex
+
+	// Memoizes the action keys of targets in this run.
+	keys map[string]string
+
+	// Memoizes the hashes of files in this run.
+	hashes map[string]string
+}
+
+// NewOutputCache returns a new OutputCache instance, backed by the given Cache.
+func NewOutputCache(cache Cache, root string) *OutputCache {
+	return &OutputCache{
+		Cache:  cache,
+		Root:   root,
+		keys:   make(map[string]string),
+		hashes: make(map[string]string),
+	}
+}
+
+// outputManifest is stored in the CacheAC namespace, and describes the outputs
+// of a target. It's encoded as an ActionResult message (see actionresult.go).
+type outputManifest struct {
+	Outputs []outputEntry
+}
+
+// outputEntry describes a single output within an outputManifest.
+type outputEntry struct {
+	// Path to the output, relative to the directory of the target.
+	Path string
+
+	// Hash of the outputs contents, which is the key in the CacheCAS
+	// namespace.
+	Hash string
+
+	// Size of the outputs contents, in bytes.
+	Size int64
+
+	// Whether the output is executable.
+	Executable bool
+}
+
+// mode returns the file mode that the output is restored with.
+func (e outputEntry) mode() os.FileMode {
+	if e.Executable {
+		return 0755
+	}
+	return 0644
+}
+
+// key returns the action key of the target. Since targets are always executed
+// after their dependencies, the dependencies will have been hashed by the time
+// this is called.
+func (c *OutputCache) key(t Target, deps []Target) (string, error) {
+	ft, ok := t.(FileTarget)
+	if !ok {
+		return "", nil
+	}
+
+	var lines []string
+	if ft.RuleFile() != "" {
+		h, err := c.hash(ft.RuleFile())
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, fmt.Sprintf("walkfile %s", h))
+	}
+
+	if h := envHash(t); h != "" {
+		lines = append(lines, fmt.Sprintf("environ %s", h))
+	}
+
+	decls := declared(t)
+	for _, name := range decls.env {
+		lines = append(lines, fmt.Sprintf("env %s=%s", name, os.Getenv(name)))
+	}
+	for _, path := range decls.outputs {
+		lines = append(lines, fmt.Sprintf("output %s", c.rel(path)))
+	}
+
+	for _, d := range deps {
+		dep, ok := d.(FileTarget)
+		if !ok {
+			continue
+		}
+		h, err := c.result(dep)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, fmt.Sprintf("dep %s %s", c.rel(dep.Path()), h))
+	}
+
+	sort.Strings(lines)
+	lines = append([]string{fmt.Sprintf("target %s", c.rel(ft.Path()))}, lines...)
+	key := hashBytes([]byte(strings.Join(lines, "\n")))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys[ft.Path()] = key
+	return key, nil
+}
+
+// restore restores the outputs of the target from the Cache. It returns false
+// if the target doesn't declare any outputs, or they aren't in the Cache. The
+// contents of each output are verified against their hash before they're
+// restored, and outputs that don't match are treated as a miss, so that
+// they're replaced when the target is executed.
+func (c *OutputCache) restore(t Target, key string) (bool, error) {
+	ft, ok := t.(FileTarget)
+	if !ok || len(declared(t).outputs) == 0 {
+		return false, nil
+	}
+
+	m, err := c.manifest(key)
+	if err != nil || m == nil {
+		return false, err
+	}
+
+	dir := filepath.Dir(ft.Path())
+	for _, e := range m.Outputs {
+		r, err := c.Cache.Get(CacheCAS, e.Hash)
+		if err == ErrCacheMiss {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		r = verifyBlob(r, e.Hash)
+		path := filepath.Join(dir, e.Path)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = writeFileAtomic(path, r, e.mode())
+		}
+		r.Close()
+		if errors.Is(err, errCorruptBlob) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// cached returns true if the manifest of the target's outputs is in the Cache,
+// in which case restore is expected to restore them. The outputs themselves
+// aren't read, so that dry runs don't download them from a remote cache.
+func (c *OutputCache) cached(t Target, key string) (bool, error) {
+	if _, ok := t.(FileTarget); !ok || len(declared(t).outputs) == 0 {
+		return false, nil
+	}
+
+	m, err := c.manifest(key)
+	return m != nil, err
+}
+
+// store stores the outputs of the target in the Cache. It returns an error if
+// any of the declared outputs weren't produced.
+func (c *OutputCache) store(t Target, key string) error {
+	ft, ok := t.(FileTarget)
+	outputs := declared(t).outputs
+	if !ok || len(outputs) == 0 {
+		return nil
+	}
+
+	var m outputManifest
+	dir := filepath.Dir(ft.Path())
+	for _, path := range outputs {
+		e, err := c.storeOutput(dir, path)
+		if err != nil {
+			return err
+		}
+		m.Outputs = append(m.Outputs, e)
+	}
+
+	raw, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return c.Cache.Put(CacheAC, key, bytes.NewReader(raw))
+}
+
+// storeOutput stores the contents of a single output in the CacheCAS
+// namespace.
+func (c *OutputCache) storeOutput(dir, path string) (outputEntry, error) {
+	e := outputEntry{}
+
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return e, err
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return e, fmt.Errorf("declared output %s was not produced", rel)
+	}
+	if err != nil {
+		return e, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return e, err
+	}
+	if !fi.Mode().IsRegular() {
+		return e, fmt.Errorf("declared output %s is not a regular file", rel)
+	}
+
+	h, err := hashFile(path)
+	if err != nil {
+		return e, err
+	}
+
+	e.Path = filepath.ToSlash(rel)
+	e.Hash = h
+	e.Size = fi.Size()
+	e.Executable = fi.Mode()&0111 != 0
+	return e, c.Cache.Put(CacheCAS, h, f)
+}
+
+// manifest returns the manifest that's stored under the action key, or nil if
+// it doesn't exist. Manifests that can't be decoded (e.g. ones that were
+// written by older versions of walk) are treated as a miss.
+func (c *OutputCache) manifest(key string) (*outputManifest, error) {
+	r, err := c.Cache.Get(CacheAC, key)
+	if err == ErrCacheMiss {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(outputManifest)
+	if err := m.UnmarshalBinary(raw); err != nil {
+		return nil, nil
+	}
+	return m, nil
+}
+
+// result returns the hash that represents the dependency within an action
+// key. For dependencies that exist on disk, this is the hash of its contents,
+// otherwise it's the action key of the dependency.
+func (c *OutputCache) result(t FileTarget) (string, error) {
+	h, err := c.hash(t.Path())
+	if err != nil || h != "" {
+		return h, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.keys[t.Path()], nil
+}
+
+// hash returns the hash of the file at path, memoizing the result.
+func (c *OutputCache) hash(path string) (string, error) {
+	c.mu.Lock()
+	h, ok := c.hashes[path]
+	c.mu.Unlock()
+	if ok {
+		return h, nil
+	}
+
+	h, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hashes[path] = h
+	return h, nil
+}
+
+// rel returns the path relative to the Root.
+func (c *OutputCache) rel(path string) string {
+	rel, err := filepath.Rel(c.Root, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
@@ -4,11 +4,16 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 // These represent the possibilities for the $1 positional argument when
@@ -22,6 +27,18 @@ const (
 // targets.
 const Walkfile = "Walkfile"
 
+// EnvDeclare is the name of the environment variable that contains the path to
+// a file, which the Walkfile can write directives to during the deps phase.
+const EnvDeclare = "WALK_DECLARE"
+
+// DefaultGracePeriod is how long the processes that a target started are given
+// to exit after being sent SIGTERM, when it's cancelled, by default.
+const DefaultGracePeriod = 10 * time.Second
+
+// errCancelled is the cause of the cancellation of in-flight targets, when a
+// target fails in fail-fast mode.
+var errCancelled = errors.New("cancelled because another target failed")
+
 // Rule defines what a target depends on, and how to execute it.
 type Rule interface {
 	// Dependencies returns the name of the targets that this target depends
@@ -51,12 +68,48 @@ type TargetOptions struct {
 	// Stdout/Stderr streams.
 	Stdout, Stderr io.Writer
 
+	// The stdin that interactive targets are attached to. The zero value
+	// is to use os.Stdin.
+	Stdin io.Reader
+
 	// If true, the stdout from the targets will be attached to the Stdout
 	// provided above.
 	Verbose bool
 
+	// The number of targets that are executed in parallel (-j), which is
+	// exported to Walkfiles.
+	Jobs uint
+
 	// If true, disables prefixing of stdout/stderr
 	NoPrefix bool
+
+	// The persistent state directory. The zero value is to not persist any
+	// state between runs.
+	State *State
+
+	// If true, the results of the deps phase are cached in the State
+	// directory, and reused until the Walkfile, the inputs that it declared,
+	// or its environment change.
+	PlanCache bool
+
+	// How long the processes that a target started are given to exit after
+	// being sent SIGTERM, when it's cancelled, before they're sent SIGKILL.
+	// The zero value is to use DefaultGracePeriod.
+	GracePeriod time.Duration
+
+	// If true, Walkfiles are executed with a minimal environment, plus the
+	// variables in Env, instead of walk's whole environment, and the
+	// environment is included in the hashes that determine whether
+	// targets are up to date.
+	Hermetic bool
+
+	// The environment variables that are passed to Walkfiles in hermetic
+	// mode, in addition to the defaults.
+	Env EnvVars
+
+	// An executable that's executed when each target starts and finishes
+	// executing. The zero value is to not execute a hook.
+	Hook string
 }
 
 // NewTarget returns a new Target instance.
@@ -69,17 +122,51 @@ func NewTarget(options TargetOptions) func(string) (Target, error) {
 		options.Stderr = os.Stderr
 	}
 
+	if options.Stdin == nil {
+		options.Stdin = os.Stdin
+	}
+
+	// Interactive targets are given exclusive access to the console, so
+	// once one is declared, all other output goes through it.
+	console := newConsole(options.Stdin, options.Stdout, options.Stderr)
+
+	if options.GracePeriod == 0 {
+		options.GracePeriod = DefaultGracePeriod
+	}
+
 	var err error
 	if options.WorkingDir == "" {
 		options.WorkingDir, err = os.Getwd()
 	}
 
+	inv := invocation{
+		root:    options.WorkingDir,
+		jobs:    options.Jobs,
+		verbose: options.Verbose,
+		depth:   currentDepth(),
+	}
+	if options.State != nil {
+		inv.root = options.State.Root
+	}
+
+	var env []string
+	if options.Hermetic {
+		env = hermeticEnv(os.Environ(), options.Env)
+	}
+
 	return func(name string) (Target, error) {
 		if err != nil {
 			return nil, err
 		}
 
 		t := newTarget(options.WorkingDir, name)
+		t.gracePeriod = options.GracePeriod
+		t.env = env
+		t.invocation = inv
+		t.console = console
+		if options.State != nil && options.PlanCache {
+			t.depsCache = &depsCache{state: options.State}
+		}
 		if options.Verbose {
 			if options.NoPrefix {
 				t.stdout = options.Stdout
@@ -95,6 +182,7 @@ func NewTarget(options TargetOptions) func(string) (Target, error) {
 		return &verboseTarget{
 			target: t,
 			stdout: options.Stdout,
+			hook:   options.Hook,
 		}, nil
 	}
 }
@@ -108,7 +196,84 @@ type Plan struct {
 	// target.
 	NewTarget func(string) (Target, error)
 
+	// DepsSemaphore controls the number of "deps" phases that are executed
+	// concurrently while planning.
+	DepsSemaphore Semaphore
+
+	// Checker is used to determine whether a target is up to date, and can
+	// be skipped during Exec. The zero value is to always execute targets.
+	Checker Checker
+
+	// OutputCache is used to restore the declared outputs of targets,
+	// instead of executing them. The zero value is to not cache outputs.
+	OutputCache *OutputCache
+
+	// The persistent state directory, where targets are locked while
+	// they're executed, and builds are recorded. The zero value is to not
+	// use a state directory.
+	State *State
+
+	// If true, the reason that each target is being executed is reported
+	// before it's executed.
+	Explain bool
+
+	// If true, a record of each time that a target is executed is stored
+	// in the State directory, which is reported by Why, and used to
+	// estimate critical paths. The reason that it was executed is only
+	// recorded when Explain is true. The zero value is to not record
+	// anything.
+	RecordBuilds bool
+
+	// If true, the first target to fail cancels all targets that are
+	// executing, and no new targets are executed. The zero value is to keep
+	// executing targets that don't depend on the failed target.
+	FailFast bool
+
+	// The number of times that a target is retried after it fails, unless
+	// the Walkfile declares otherwise. The zero value is to not retry.
+	Retries int
+
+	// Pools limit the number of targets that use a resource concurrently.
+	// The zero value is for every pool to be unlimited.
+	Pools *Pools
+
+	// The maximum number of targets that Exec walks at the same time,
+	// including targets that are waiting for a pool, or a slot in the
+	// semaphore. The zero value is to walk each target as soon as its
+	// dependencies have been, and leave it to the pools and semaphore to
+	// limit how many are executed, so that targets that are waiting for a
+	// pool don't hold up targets that aren't.
+	Workers int
+
+	// If true, walks that are executed by Walkfiles during Exec join it,
+	// through a socket that's exported as $WALK_SOCKET, instead of
+	// executing their targets on their own. Their targets are executed
+	// with this Plan's configuration, instead of their own.
+	Join bool
+
+	// The directory that the names of targets submitted by nested walks
+	// are made relative to. The zero value is to use os.Getwd().
+	WorkingDir string
+
+	// Where warnings are printed, such as the targets that succeeded after
+	// being retried, when Exec succeeds. When it fails, they're included in
+	// the WalkError instead. The zero value is to not print warnings.
+	Warnings io.Writer
+
 	graph *Graph
+
+	// When replanning, the graph from the previous plan. Its targets, and
+	// their dependencies, are reused instead of executing the deps phase
+	// again, unless they're stale.
+	previous *Graph
+	stale    map[string]bool
+
+	// If set, only these targets are executed, and the rest are assumed to
+	// be up to date.
+	only map[string]bool
+
+	// If set, called with each target after it's executed successfully.
+	executed func(Target)
 }
 
 // Exec is a simple helper to build and execute a target.
@@ -124,8 +289,9 @@ func Exec(ctx context.Context, semaphore Semaphore, targets ...string) error {
 // newPlan returns a new initialized Plan instance.
 func newPlan() *Plan {
 	return &Plan{
-		NewTarget: NewTarget(TargetOptions{}),
-		graph:     newGraph(),
+		NewTarget:     NewTarget(TargetOptions{}),
+		DepsSemaphore: NewSemaphore(0),
+		graph:         newGraph(),
 	}
 }
 
@@ -137,17 +303,13 @@ func (p *Plan) String() string {
 
 // Plan builds the graph, starting with the given target. It recursively
 // executes the "deps" phase of the targets rule, adding each dependency to the
-// graph as their found.
+// graph as their found. Dependencies are resolved concurrently, limited by the
+// DepsSemaphore.
 func (p *Plan) Plan(ctx context.Context, targets ...string) error {
-	for _, target := range targets {
-		_, err := p.newTarget(ctx, target)
-		if err != nil {
-			return err
-		}
-	}
-
 	// Add a root target, with all of the given targets as it's dependency.
-	if err := p.addTarget(ctx, &rootTarget{deps: targets}); err != nil {
+	root := &rootTarget{deps: targets}
+	p.graph.Add(root)
+	if err := p.addDependencies(ctx, root); err != nil {
 		return err
 	}
 
@@ -160,54 +322,387 @@ func (p *Plan) Plan(ctx context.Context, targets ...string) error {
 	return nil
 }
 
-// addTarget adds the given Target to the graph, as well as it's dependencies,
-// then connects the target to it's dependency with an edge.
-func (p *Plan) addTarget(ctx context.Context, t Target) error {
-	p.graph.Add(t)
-
-	deps, err := t.Dependencies(ctx)
+// addDependencies executes the "deps" phase of the given Target, then adds
+// each dependency to the graph in parallel and connects the target to it's
+// dependency with an edge.
+func (p *Plan) addDependencies(ctx context.Context, t Target) error {
+	deps, err := p.dependencies(ctx, t)
 	if err != nil {
 		return fmt.Errorf("error getting dependencies for %s: %v", t.Name(), err)
 	}
 
+	errs := make(chan error, len(deps))
 	for _, d := range deps {
-		// TODO(ejholmes): Accept a semaphore and parallelize this. No
-		// need to perform this serially.
-		dep, err := p.newTarget(ctx, d)
-		if err != nil {
-			return err
+		go func(d string) {
+			dep, err := p.newTarget(withParents(ctx, t), d)
+			if err == nil {
+				p.graph.Connect(t, dep)
+			}
+			errs <- err
+		}(d)
+	}
+
+	// Wait for the entire subgraph to be added, returning the first error
+	// encountered.
+	for range deps {
+		if e := <-errs; e != nil && err == nil {
+			err = e
 		}
-		p.graph.Connect(t, dep)
 	}
 
-	return nil
+	return err
+}
+
+// dependencies executes the "deps" phase of the target, while holding the
+// DepsSemaphore.
+func (p *Plan) dependencies(ctx context.Context, t Target) ([]string, error) {
+	if p.reused(t) {
+		var deps []string
+		for _, dep := range p.previous.DeclaredDependencies(t) {
+			deps = append(deps, dep.Name())
+		}
+		return deps, nil
+	}
+
+	p.DepsSemaphore.P()
+	defer p.DepsSemaphore.V()
+	return t.Dependencies(ctx)
 }
 
 // newTarget instantiates a new Target instance using the Plan's NewTarget
-// method, and adds it to the graph, if it hasn't already been added.
+// method, and adds it to the graph, if it hasn't already been added. The
+// dependencies of a target are only ever resolved by the caller that
+// successfully added it to the graph.
 func (p *Plan) newTarget(ctx context.Context, target string) (Target, error) {
 	// Target already exists in the graph.
 	if t := p.graph.Target(target); t != nil {
 		return t, nil
 	}
 
-	t, err := p.NewTarget(target)
+	t, err := p.reuse(target)
 	if err != nil {
 		return t, err
 	}
 
-	return t, p.addTarget(ctx, t)
+	// Another caller raced us to add this target to the graph, and is
+	// responsible for resolving it's dependencies.
+	if existing := p.graph.Add(t); existing != nil {
+		return existing, nil
+	}
+
+	return t, p.addDependencies(ctx, t)
+}
+
+// reuse returns the target from the previous plan, unless it's stale, in
+// which case a new Target instance is returned.
+func (p *Plan) reuse(target string) (Target, error) {
+	if p.previous != nil && !p.stale[target] {
+		if t := p.previous.Target(target); t != nil {
+			return t, nil
+		}
+	}
+	return p.NewTarget(target)
+}
+
+// reused returns true if the target was reused from the previous plan.
+func (p *Plan) reused(t Target) bool {
+	return p.previous != nil && !p.stale[t.Name()] && p.previous.Target(t.Name()) == t
 }
 
 // Exec begins walking the graph, executing the "exec" phase of each targets
 // Rule. Targets Exec functions are guaranteed to be called when all of the
 // Targets dependencies have been fulfilled.
+//
+// Targets that aren't executed, because one of their dependencies failed, are
+// reported as skipped. When the semaphore limits concurrency, targets that
+// are ready to be executed are started in order of their estimated critical
+// path.
 func (p *Plan) Exec(ctx context.Context, semaphore Semaphore) error {
-	return p.graph.Walk(func(t Target) error {
-		semaphore.P()
-		defer semaphore.V()
-		return t.Exec(ctx)
+	// Only cancelled in fail-fast mode.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// The hooks of targets that aren't executed are executed in the
+	// background (see report), and waited for before returning.
+	var hooks sync.WaitGroup
+	defer hooks.Wait()
+	ctx = context.WithValue(ctx, hooksKey{}, &hooks)
+
+	e := newExecution(newScheduler(semaphore, p.graph, p.State), cancel)
+
+	if p.Join {
+		s, err := p.listen(ctx, e)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		ctx = context.WithValue(ctx, socketKey{}, s.path())
+	}
+
+	err := p.walk(ctx, e)
+	if retried := p.retried(e); err == nil && len(retried) > 0 && p.Warnings != nil {
+		var details []string
+		for name, n := range retried {
+			details = append(details, fmt.Sprintf("%s after %d attempts", name, n))
+		}
+		sort.Strings(details)
+		fmt.Fprintf(p.Warnings, "%s\n", ansi("33", "warning: %d %s succeeded after being retried (%s)", len(retried), pluralize(len(retried), "target", "targets"), strings.Join(details, ", ")))
+	}
+	return err
+}
+
+// walk executes the targets in the graph, within the execution.
+func (p *Plan) walk(ctx context.Context, e *execution) error {
+	err := p.graph.Walk(ctx, func(t Target) (err error) {
+		// The target may have been executed by a nested walk, or the
+		// walk that this one joined.
+		b, ok := e.start(t)
+		if !ok {
+			<-b.done
+			return b.err
+		}
+		defer func() { e.finish(b, err) }()
+
+		// The targets that depend on this one are exported to it, and
+		// its hook, as its parents.
+		err = p.exec(withParents(ctx, p.graph.Dependents(t)...), e, t)
+		if err == nil || !p.FailFast {
+			return err
+		}
+
+		// This target was interrupted by the failure of another
+		// target.
+		if context.Cause(ctx) == errCancelled {
+			return fmt.Errorf("%w: %v", errCancelled, err)
+		}
+
+		e.cancel(errCancelled)
+		return err
+	}, WalkOptions{
+		Workers: p.Workers,
+		Less:    e.scheduler.less,
+		// Unlike targets that are up to date, targets that are skipped
+		// because a dependency failed are reported with the dependency.
+		Skip: func(t, failed Target) {
+			report(withParents(ctx, p.graph.Dependents(t)...), t, StatusSkip, fmt.Sprintf("dependency %s failed", failed.Name()))
+		},
+	})
+
+	var werr *WalkError
+	if errors.As(err, &werr) {
+		werr.Retried = p.retried(e)
+	}
+	return err
+}
+
+// retried returns the targets in the graph that were executed successfully
+// after being retried, mapped to the number of attempts that it took.
+func (p *Plan) retried(e *execution) map[string]int {
+	retried := make(map[string]int)
+	for _, t := range p.graph.Sorted() {
+		if n := e.attempts(t); n > 0 {
+			retried[t.Name()] = n
+		}
+	}
+	return retried
+}
+
+// acquire acquires what the target holds while it's executed, and returns a
+// function that releases it, and whether it had to wait for another walk to
+// release the target's lock. The lock, and then pools, are acquired first, so
+// that targets that are waiting on them don't hold a slot in the semaphore.
+func (p *Plan) acquire(ctx context.Context, e *execution, t Target) (release func(), waited bool, err error) {
+	unlock, waited, err := p.lock(ctx, t)
+	if err != nil {
+		return nil, false, err
+	}
+
+	releasePools, err := p.Pools.acquire(ctx, declared(t).pools)
+	if err != nil {
+		unlock()
+		return nil, false, err
+	}
+
+	if err := e.scheduler.P(ctx, t); err != nil {
+		releasePools()
+		unlock()
+		return nil, false, err
+	}
+	e.hold(t, true)
+	return func() {
+		e.hold(t, false)
+		e.scheduler.V()
+		releasePools()
+		unlock()
+	}, waited, nil
+}
+
+// waitFailed reports the error from waiting for a lock, or pools, before the
+// target was executed.
+func waitFailed(ctx context.Context, t Target, err error) error {
+	switch {
+	case err == errCancelled:
+		return err
+	case timedOut(ctx) != nil:
+		report(ctx, t, StatusTimeout, err.Error())
+		return err
+	}
+	return failed(ctx, t, err)
+}
+
+// lock takes the target's lock in the State directory, unless there's no State,
+// or the target isn't executed by a Walkfile. Another walk may be executing the
+// same target, in which case this one waits for it, and returns true, so that
+// exec checks whether it's up to date again.
+func (p *Plan) lock(ctx context.Context, t Target) (unlock func(), waited bool, err error) {
+	if ft, ok := t.(FileTarget); p.State == nil || !ok || ft.RuleFile() == "" {
+		return func() {}, false, nil
+	}
+	unlock, err = p.State.lock(ctx, buildKey(t), func() {
+		waited = true
+		report(ctx, t, StatusWaiting, "lock is held by another walk")
 	})
+	return unlock, waited, err
+}
+
+// check returns the reason that the target needs to be executed, or "" if the
+// Checker determines that it's up to date.
+func (p *Plan) check(t Target, deps []Target) (string, error) {
+	if p.Checker == nil {
+		return reasonForced, nil
+	}
+	return p.Checker.Check(t, deps)
+}
+
+// exec executes the target, unless the Checker determines that it's up to
+// date. The target's lock, pools, and slot in the semaphore are only acquired
+// once it's known to need executing.
+func (p *Plan) exec(ctx context.Context, e *execution, t Target) error {
+	// A target has already failed, so don't start any more.
+	if context.Cause(ctx) == errCancelled {
+		return errCancelled
+	}
+
+	// Every dependency that the target declared is an input, even if it's
+	// also a dependency of another dependency.
+	deps := p.graph.DeclaredDependencies(t)
+
+	var key string
+	if p.OutputCache != nil {
+		var err error
+		if key, err = p.OutputCache.key(t, deps); err != nil {
+			return failed(ctx, t, err)
+		}
+	}
+
+	if p.only != nil && !p.only[t.Name()] {
+		return nil
+	}
+
+	reason, err := p.check(t, deps)
+	if err != nil {
+		return failed(ctx, t, err)
+	}
+	if reason == "" {
+		report(ctx, t, StatusSkip, "")
+		return nil
+	}
+
+	release, waited, err := p.acquire(ctx, e, t)
+	if err != nil {
+		return waitFailed(ctx, t, err)
+	}
+	defer func() { release() }()
+
+	// A target may have failed while this one was waiting.
+	if context.Cause(ctx) == errCancelled {
+		return errCancelled
+	}
+
+	// The walk that held the lock was probably executing the target, so
+	// it may be up to date now.
+	if waited {
+		if reason, err = p.check(t, deps); err != nil {
+			return failed(ctx, t, err)
+		}
+		if reason == "" {
+			report(ctx, t, StatusSkip, "")
+			return nil
+		}
+	}
+
+	if p.Explain {
+		report(ctx, t, StatusExplain, reason)
+	}
+
+	// What the target holds is released while it waits to be retried, so
+	// that other targets can use it in the meantime.
+	pause := func(d time.Duration) error {
+		release()
+		release = func() {}
+
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+
+		r, _, err := p.acquire(ctx, e, t)
+		if err != nil {
+			return err
+		}
+		release = r
+		return nil
+	}
+
+	start := time.Now()
+	err = p.run(ctx, e, t, key, pause)
+	if p.State != nil && p.RecordBuilds {
+		if rerr := p.recordBuild(t, reason, start, err); rerr != nil && err == nil {
+			return failed(ctx, t, rerr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if p.Checker != nil {
+		if err := p.Checker.Record(t, deps); err != nil {
+			return failed(ctx, t, err)
+		}
+	}
+
+	if p.executed != nil {
+		p.executed(t)
+	}
+	return nil
+}
+
+// run restores the outputs of the target from the OutputCache if they're
+// available, otherwise the target is executed, and its outputs are stored in
+// the OutputCache.
+func (p *Plan) run(ctx context.Context, e *execution, t Target, key string, pause func(time.Duration) error) error {
+	if p.OutputCache == nil {
+		return p.execRetries(ctx, e, t, pause)
+	}
+
+	restored, err := p.OutputCache.restore(t, key)
+	if err != nil {
+		return failed(ctx, t, err)
+	}
+	if restored {
+		report(ctx, t, StatusCached, "")
+		return nil
+	}
+
+	if err := p.execRetries(ctx, e, t, pause); err != nil {
+		return err
+	}
+
+	if err := p.OutputCache.store(t, key); err != nil {
+		return failed(ctx, t, err)
+	}
+	return nil
 }
 
 // targetError is an error implementation that provides additional information
@@ -241,6 +736,25 @@ type target struct {
 	// The working directory.
 	wd string
 
+	// If provided, the results of the deps phase will be cached here.
+	depsCache *depsCache
+
+	// The directives that the Walkfile declared during the deps phase.
+	declarations *declarations
+
+	// How long processes are given to exit after being sent SIGTERM.
+	gracePeriod time.Duration
+
+	// In hermetic mode, the environment that the Walkfile is executed
+	// with, excluding the variables that walk manages.
+	env []string
+
+	// How walk was executed, which is exported to the Walkfile.
+	invocation invocation
+
+	// The console that interactive targets are attached to.
+	console *console
+
 	stdout, stderr io.Writer
 }
 
@@ -256,11 +770,12 @@ func newTarget(wd, name string) *target {
 	}
 
 	return &target{
-		name:     name,
-		path:     path,
-		rulefile: rulefile,
-		dir:      dir,
-		wd:       wd,
+		name:         name,
+		path:         path,
+		rulefile:     rulefile,
+		dir:          dir,
+		wd:           wd,
+		declarations: new(declarations),
 	}
 }
 
@@ -269,6 +784,24 @@ func (t *target) Name() string {
 	return t.name
 }
 
+// Path implements the FileTarget interface.
+func (t *target) Path() string {
+	return t.path
+}
+
+// RuleFile implements the FileTarget interface.
+func (t *target) RuleFile() string {
+	return t.rulefile
+}
+
+func (t *target) declared() *declarations {
+	return t.declarations
+}
+
+func (t *target) environment() []string {
+	return t.env
+}
+
 // Exec executes the rule with "exec" as the first argument.
 func (t *target) Exec(ctx context.Context) error {
 	// No .walk file, meaning it's a static dependency.
@@ -276,30 +809,91 @@ func (t *target) Exec(ctx context.Context) error {
 		return nil
 	}
 
-	cmd, err := t.ruleCommand(ctx, PhaseExec)
+	// Directives are only read during the deps phase. In all other cases,
+	// they're discarded.
+	cmd, release, err := t.ruleCommand(ctx, PhaseExec, os.DevNull)
 	if err != nil {
 		return err
 	}
+	defer release()
+
+	// Interactive targets are attached to the console directly, instead
+	// of having their output prefixed, while the output of all other
+	// targets is paused. If it's a terminal, their process group is made
+	// the foreground process group, so that they can read from it.
+	if t.declarations.interactive && t.console != nil {
+		unpause := t.console.acquire()
+		defer unpause()
+		cmd.Stdin = t.console.stdin
+		cmd.Stdout, cmd.Stderr = t.console.stdout, t.console.stderr
+		if f, ok := cmd.Stdin.(*os.File); ok && isTerminal(f) {
+			defer setForeground(cmd, f)()
+		}
+	}
 	return cmd.Run()
 }
 
 // Dependencies executes the rule with "deps" as the first argument, and parses
-// out the newline delimited list of dependencies.
+// out the newline delimited list of dependencies. If a deps cache is
+// configured, and the cached result is still valid, the rule is not executed.
 func (t *target) Dependencies(ctx context.Context) ([]string, error) {
 	// No .walk file, meaning it's a static dependency.
 	if t.rulefile == "" {
 		return nil, nil
 	}
 
-	b := new(bytes.Buffer)
-	cmd, err := t.ruleCommand(ctx, PhaseDeps)
+	if t.depsCache != nil {
+		e, err := t.depsCache.get(ctx, t)
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			if err := t.declare(e.Declarations); err != nil {
+				return nil, err
+			}
+			return t.relative(e.Deps)
+		}
+	}
+
+	deps, decls, err := t.dependencies(ctx)
 	if err != nil {
 		return nil, err
 	}
+
+	if err := t.declare(decls); err != nil {
+		return nil, err
+	}
+
+	if t.depsCache != nil {
+		if err := t.depsCache.put(ctx, t, deps, decls, t.declarations.inputs); err != nil {
+			return nil, err
+		}
+	}
+
+	return t.relative(deps)
+}
+
+// dependencies executes the rule with "deps" as the first argument, and
+// returns the absolute paths to the dependencies, as well as any directives
+// the Walkfile declared.
+func (t *target) dependencies(ctx context.Context) ([]string, []string, error) {
+	f, err := os.CreateTemp("", "walk-declare-")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	b := new(bytes.Buffer)
+	cmd, release, err := t.ruleCommand(ctx, PhaseDeps, f.Name())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
 	cmd.Stdout = b
 
 	if err := cmd.Run(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var deps []string
@@ -311,55 +905,205 @@ func (t *target) Dependencies(ctx context.Context) ([]string, error) {
 		}
 
 		// If the path is not already and absolute path, make it one.
-		if !filepath.IsAbs(path) {
-			path = filepath.Join(t.dir, path)
-		}
+		deps = append(deps, abs(t.dir, path))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	decls, err := readDeclarations(f)
+	return deps, decls, err
+}
 
-		// Make all paths relative to the working directory.
+// declare parses the directives that the Walkfile declared for this target.
+func (t *target) declare(lines []string) error {
+	d, err := parseDeclarations(t.dir, lines)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", EnvDeclare, err)
+	}
+	t.declarations = d
+	if d.interactive {
+		t.console.enable()
+	}
+	return nil
+}
+
+// relative makes all of the given absolute paths relative to the working
+// directory.
+func (t *target) relative(paths []string) ([]string, error) {
+	var rel []string
+	for _, path := range paths {
 		path, err := filepath.Rel(t.wd, path)
 		if err != nil {
-			return deps, err
+			return rel, err
 		}
-		deps = append(deps, path)
+		rel = append(rel, path)
 	}
-
-	return deps, scanner.Err()
+	return rel, nil
 }
 
-func (t *target) ruleCommand(ctx context.Context, phase string) (*exec.Cmd, error) {
+// ruleCommand returns the command that executes the phase of the rule, with
+// $WALK_DECLARE set to declare. The returned function must be called after the
+// command has been waited for.
+func (t *target) ruleCommand(ctx context.Context, phase, declare string) (*exec.Cmd, func(), error) {
 	name := filepath.Base(t.path)
 	cmd := exec.CommandContext(ctx, t.rulefile, phase, name)
-	cmd.Stdout = t.stdout
-	cmd.Stderr = t.stderr
+	cmd.Stdout = t.console.writer(t.stdout)
+	cmd.Stderr = t.console.writer(t.stderr)
 	cmd.Dir = t.dir
-	return cmd, nil
+	release := setProcessGroup(cmd, t.gracePeriod)
+	cmd.Env = append(t.environ(), t.protocolEnv(ctx)...)
+	shareJobserver(ctx, cmd)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", EnvDeclare, declare))
+	return cmd, release, nil
+}
+
+// environ returns the environment that the Walkfile, and the hook, are
+// executed with, before the protocol's variables are added. In hermetic mode,
+// only the variables that walk manages are passed through.
+func (t *target) environ() []string {
+	if t.env == nil {
+		return os.Environ()
+	}
+	return append(managedEnv(os.Environ()), t.env...)
+}
+
+// These are the statuses that are reported for targets during the exec phase.
+const (
+	StatusOK        = "ok"
+	StatusError     = "error"
+	StatusSkip      = "skip"
+	StatusCached    = "cached"
+	StatusExplain   = "explain"
+	StatusCancelled = "cancelled"
+	StatusRetry     = "retry"
+	StatusTimeout   = "timeout"
+	StatusWaiting   = "waiting"
+)
+
+// Maps a status to the ansi color that it's printed with.
+var statusColors = map[string]string{
+	StatusOK:        "32",
+	StatusError:     "31",
+	StatusSkip:      "33",
+	StatusCached:    "34",
+	StatusExplain:   "35",
+	StatusCancelled: "36",
+	StatusRetry:     "33",
+	StatusTimeout:   "31",
+	StatusWaiting:   "36",
+}
+
+// reporter is implemented by targets that report their status during the exec
+// phase.
+type reporter interface {
+	report(status, detail string)
+	hookFinish(ctx context.Context, phase string, d time.Duration, status string)
+}
+
+// hooksKey is the context key for the hooks that report executes in the
+// background, which Exec waits for before it returns.
+type hooksKey struct{}
+
+// report reports the status of a target that was not executed through its Exec
+// method (e.g. because it was up to date), if the target supports it. Like
+// when it's executed, the finish hook is executed for the status, unless the
+// target is still waiting to be executed, but without a start, since nothing
+// was started. During Exec, the hook is executed in the background, so that
+// targets that aren't executed don't hold up the walk.
+func report(ctx context.Context, t Target, status, detail string) {
+	r, ok := t.(reporter)
+	if !ok {
+		return
+	}
+	r.report(status, detail)
+	if status == StatusWaiting || status == StatusExplain {
+		return
+	}
+
+	hooks, ok := ctx.Value(hooksKey{}).(*sync.WaitGroup)
+	if !ok {
+		r.hookFinish(ctx, PhaseExec, 0, status)
+		return
+	}
+	hooks.Add(1)
+	go func() {
+		defer hooks.Done()
+		r.hookFinish(ctx, PhaseExec, 0, status)
+	}()
+}
+
+// failed reports that the target failed, for errors that occur outside of the
+// target's Exec method.
+func failed(ctx context.Context, t Target, err error) error {
+	report(ctx, t, StatusError, err.Error())
+	return err
 }
 
 // verboseTarget simply wraps a target to print to to stdout when it's Exec'd.
 type verboseTarget struct {
 	*target
 	stdout io.Writer
+
+	// The hook that's executed when the target starts and finishes.
+	hook string
 }
 
 func (t *verboseTarget) Exec(ctx context.Context) error {
+	return t.execAttempt(ctx, attempt{n: 1, max: 1})
+}
+
+// execAttempt implements the attempter interface.
+func (t *verboseTarget) execAttempt(ctx context.Context, a attempt) error {
+	t.hookStart(ctx, PhaseExec)
+	start := time.Now()
 	err := t.target.Exec(ctx)
-	prefix := "ok"
-	color := "32"
+	status := t.finish(ctx, a, err)
+	t.hookFinish(ctx, PhaseExec, time.Since(start), status)
 	if err != nil {
-		prefix = "error"
-		color = "31"
+		return &targetError{t.target, err}
 	}
-	line := fmt.Sprintf("%s\t%s", ansi(color, "%s", prefix), t.target.Name())
-	if err != nil {
-		line = fmt.Sprintf("%s\t%s", line, err)
+	return nil
+}
+
+// finish reports the result of the attempt at executing the target, and
+// returns the status that it was reported with.
+func (t *verboseTarget) finish(ctx context.Context, a attempt, err error) string {
+	if err == nil {
+		detail := ""
+		if a.n > 1 {
+			detail = a.String()
+		}
+		t.report(StatusOK, detail)
+		return StatusOK
 	}
-	if t.rulefile != "" {
-		fmt.Fprintf(t.stdout, "%s\n", line)
+
+	status, detail := StatusError, err.Error()
+	if cause := timedOut(ctx); cause != nil {
+		status, detail = StatusTimeout, cause.Error()
 	}
-	if err != nil {
-		return &targetError{t.target, err}
+
+	if context.Cause(ctx) == errCancelled {
+		status = StatusCancelled
+	} else if a.retrying(ctx) {
+		status, detail = StatusRetry, fmt.Sprintf("%s: %s", a, detail)
 	}
-	return err
+
+	t.report(status, detail)
+	return status
+}
+
+// report prints a line with the status of the target to stdout. Static files
+// aren't shown.
+func (t *verboseTarget) report(status, detail string) {
+	if t.rulefile == "" {
+		return
+	}
+	line := fmt.Sprintf("%s\t%s", ansi(statusColors[status], "%s", status), t.target.Name())
+	if detail != "" {
+		line = fmt.Sprintf("%s\t%s", line, detail)
+	}
+	fmt.Fprintf(t.console.writer(t.stdout), "%s\n", line)
 }
 
 // RuleFile is used to determine the path to an executable which will be used as
@@ -3,10 +3,13 @@ package main
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -45,8 +48,70 @@ func TestPlan_Cancel(t *testing.T) {
 	defer cancel()
 	err := Exec(ctx, NewSemaphore(0), "test/000-cancel/all").(*WalkError)
 	assert.Equal(t, 2, len(err.Errors))
-	assert.True(t, strings.Contains(err.Errors["test/000-cancel/b.sleep"].Error(), "signal: killed"))
-	assert.True(t, strings.Contains(err.Errors["test/000-cancel/a.sleep"].Error(), "signal: killed"))
+	assert.True(t, strings.Contains(err.Errors["test/000-cancel/b.sleep"].Error(), "signal: terminated"))
+	assert.True(t, strings.Contains(err.Errors["test/000-cancel/a.sleep"].Error(), "signal: terminated"))
+}
+
+func TestPlan_FailFast(t *testing.T) {
+	clean(t)
+
+	b := new(syncBuffer)
+	plan := newPlan()
+	plan.NewTarget = NewTarget(TargetOptions{
+		Stdout: b,
+	})
+	plan.FailFast = true
+	err := plan.Plan(ctx, "test/000-cancel/fail-fast")
+	assert.NoError(t, err)
+
+	start := time.Now()
+	err = plan.Exec(ctx, NewSemaphore(0))
+	assert.Less(t, time.Since(start), 10*time.Second)
+
+	// Targets that were interrupted, or never started, are cancelled
+	// instead of failed.
+	werr := err.(*WalkError)
+	assert.Equal(t, []string{"test/000-cancel/fail"}, keys(werr.Errors))
+	assert.Equal(t, []string{"test/000-cancel/a.sleep", "test/000-cancel/b.sleep"}, keys(werr.Cancelled))
+	assert.Equal(t, map[string]string{"test/000-cancel/fail-fast": "test/000-cancel/fail"}, werr.Skipped)
+	assert.Equal(t, "1 target failed, 1 skipped, 2 cancelled", err.Error())
+	assert.Contains(t, b.String(), "error\ttest/000-cancel/fail\texit status 1\n")
+	assert.NotContains(t, b.String(), "error\ttest/000-cancel/a.sleep")
+}
+
+func TestPlan_ConcurrentDependencies(t *testing.T) {
+	// A diamond shaped graph, where "d" is depended on by both "b" and
+	// "c".
+	graph := map[string][]string{
+		"a": {"b", "c"},
+		"b": {"d"},
+		"c": {"d"},
+		"d": nil,
+	}
+
+	var mu sync.Mutex
+	calls := make(map[string]int)
+
+	plan := newPlan()
+	plan.DepsSemaphore = NewSemaphore(2)
+	plan.NewTarget = func(name string) (Target, error) {
+		return &depsTarget{
+			testTarget: testTarget{name: name},
+			deps:       graph[name],
+			called: func() {
+				mu.Lock()
+				defer mu.Unlock()
+				calls[name]++
+			},
+		}, nil
+	}
+
+	err := plan.Plan(ctx, "a")
+	assert.NoError(t, err)
+
+	// The dependencies of each target should only be resolved once.
+	assert.Equal(t, map[string]int{"a": 1, "b": 1, "c": 1, "d": 1}, calls)
+	assert.Equal(t, "(root)\n  a\na\n  b\n  c\nb\n  d\nc\n  d\nd\n", plan.String())
 }
 
 func TestTarget_Dependencies(t *testing.T) {
@@ -76,10 +141,677 @@ func TestTarget_Dependencies_EmptyTarget(t *testing.T) {
 	assert.Equal(t, []string{"test/000-empty-dependency/a", "test/000-empty-dependency/b"}, deps)
 }
 
+func TestTarget_Dependencies_Cache(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $1 in
+  deps)
+    echo run >> runs
+    echo "input deps.txt" >> "$WALK_DECLARE"
+    cat deps.txt
+    ;;
+esac
+`)
+	writeFile(t, filepath.Join(dir, "deps.txt"), "a\n")
+
+	jobs := uint(1)
+	dependencies := func() []string {
+		target := newTarget(dir, "all")
+		target.invocation.jobs = jobs
+		target.depsCache = &depsCache{state: FindState(dir)}
+		deps, err := target.Dependencies(ctx)
+		assert.NoError(t, err)
+		return deps
+	}
+	runs := func() int {
+		raw, err := os.ReadFile(filepath.Join(dir, "runs"))
+		assert.NoError(t, err)
+		return strings.Count(string(raw), "run")
+	}
+
+	assert.Equal(t, []string{"a"}, dependencies())
+	assert.Equal(t, 1, runs())
+
+	// Cached.
+	assert.Equal(t, []string{"a"}, dependencies())
+	assert.Equal(t, 1, runs())
+
+	// Declared input changed.
+	writeFile(t, filepath.Join(dir, "deps.txt"), "a\nb\n")
+	assert.Equal(t, []string{"a", "b"}, dependencies())
+	assert.Equal(t, 2, runs())
+
+	// Walkfile changed.
+	f, err := os.OpenFile(filepath.Join(dir, "Walkfile"), os.O_APPEND|os.O_WRONLY, 0)
+	assert.NoError(t, err)
+	_, err = f.WriteString("# comment\n")
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, []string{"a", "b"}, dependencies())
+	assert.Equal(t, 3, runs())
+
+	// Protocol variables changed.
+	jobs = 2
+	assert.Equal(t, []string{"a", "b"}, dependencies())
+	assert.Equal(t, 4, runs())
+}
+
+func TestPlan_Hash(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  all)
+    case $1 in
+      deps) echo out.txt ;;
+    esac ;;
+  out.txt)
+    case $1 in
+      deps) echo in.txt ;;
+      exec) echo run >> runs && cp in.txt out.txt ;;
+    esac ;;
+esac
+`)
+	writeFile(t, filepath.Join(dir, "in.txt"), "a\n")
+
+	exec := func() string {
+		b := new(syncBuffer)
+		plan := newPlan()
+		plan.NewTarget = NewTarget(TargetOptions{
+			WorkingDir: dir,
+			Stdout:     b,
+		})
+		plan.Checker = newHashChecker(FindState(dir))
+		err := plan.Plan(ctx, "all")
+		assert.NoError(t, err)
+		err = plan.Exec(ctx, NewSemaphore(1))
+		assert.NoError(t, err)
+		return b.String()
+	}
+
+	assert.Equal(t, "ok\tin.txt\nok\tout.txt\nok\tall\n", exec())
+	assert.Equal(t, "skip\tin.txt\nskip\tout.txt\nok\tall\n", exec())
+
+	// Dependency changed.
+	writeFile(t, filepath.Join(dir, "in.txt"), "b\n")
+	assert.Equal(t, "ok\tin.txt\nok\tout.txt\nok\tall\n", exec())
+
+	// Target changed.
+	writeFile(t, filepath.Join(dir, "out.txt"), "c\n")
+	assert.Equal(t, "skip\tin.txt\nok\tout.txt\nok\tall\n", exec())
+	assert.Equal(t, "skip\tin.txt\nskip\tout.txt\nok\tall\n", exec())
+
+	raw, err := os.ReadFile(filepath.Join(dir, "runs"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(raw), "run"))
+}
+
+func TestPlan_Hash_TransitiveDependency(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  mid.txt)
+    case $1 in
+      deps) echo in.txt ;;
+      exec) head -1 in.txt > mid.txt ;;
+    esac ;;
+  out.txt)
+    case $1 in
+      deps) echo mid.txt; echo in.txt ;;
+      exec) cat mid.txt in.txt > out.txt ;;
+    esac ;;
+esac
+`)
+	writeFile(t, filepath.Join(dir, "in.txt"), "a\nb\n")
+
+	exec := func() string {
+		b := new(syncBuffer)
+		plan := newPlan()
+		plan.NewTarget = NewTarget(TargetOptions{
+			WorkingDir: dir,
+			Stdout:     b,
+		})
+		plan.Checker = newHashChecker(FindState(dir))
+		err := plan.Plan(ctx, "out.txt")
+		assert.NoError(t, err)
+		err = plan.Exec(ctx, NewSemaphore(1))
+		assert.NoError(t, err)
+		return b.String()
+	}
+
+	assert.Equal(t, "ok\tin.txt\nok\tmid.txt\nok\tout.txt\n", exec())
+
+	// in.txt is also a dependency of mid.txt, whose result doesn't change,
+	// but out.txt declared it too.
+	writeFile(t, filepath.Join(dir, "in.txt"), "a\nc\n")
+	assert.Equal(t, "ok\tin.txt\nok\tmid.txt\nok\tout.txt\n", exec())
+
+	raw, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a\na\nc\n", string(raw))
+}
+
+func TestPlan_Hermetic(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  out.txt)
+    case $1 in
+      exec) echo "$GREETING $NAME ${SECRET:-unset}" > out.txt ;;
+    esac ;;
+esac
+`)
+	t.Setenv("NAME", "world")
+	t.Setenv("SECRET", "hunter2")
+
+	exec := func(env ...string) (string, string) {
+		b := new(syncBuffer)
+		plan := newPlan()
+		plan.NewTarget = NewTarget(TargetOptions{
+			WorkingDir: dir,
+			Stdout:     b,
+			Hermetic:   true,
+			Env:        env,
+		})
+		plan.Checker = newHashChecker(FindState(dir))
+		err := plan.Plan(ctx, "out.txt")
+		assert.NoError(t, err)
+		err = plan.Exec(ctx, NewSemaphore(1))
+		assert.NoError(t, err)
+		raw, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+		assert.NoError(t, err)
+		return b.String(), string(raw)
+	}
+
+	status, out := exec("GREETING=hello", "NAME")
+	assert.Equal(t, "ok\tout.txt\n", status)
+	assert.Equal(t, "hello world unset\n", out)
+
+	status, _ = exec("GREETING=hello", "NAME")
+	assert.Equal(t, "skip\tout.txt\n", status)
+
+	// The allowed variables are part of the hash.
+	status, out = exec("GREETING=goodbye", "NAME")
+	assert.Equal(t, "ok\tout.txt\n", status)
+	assert.Equal(t, "goodbye world unset\n", out)
+
+	t.Setenv("NAME", "walk")
+	status, out = exec("GREETING=goodbye", "NAME")
+	assert.Equal(t, "ok\tout.txt\n", status)
+	assert.Equal(t, "goodbye walk unset\n", out)
+
+	// But the rest of the environment isn't.
+	t.Setenv("SECRET", "hunter3")
+	status, _ = exec("GREETING=goodbye", "NAME")
+	assert.Equal(t, "skip\tout.txt\n", status)
+}
+
+func TestPlan_Protocol(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  all)
+    case $1 in
+      deps) echo lib/lib.a ;;
+    esac ;;
+esac
+`)
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "lib"), 0755))
+	writeFile(t, filepath.Join(dir, "lib", "Walkfile"), `#!/bin/bash
+echo "$WALK_PROTOCOL $WALK_ROOT $WALK_TARGET $WALK_TARGET_PATH $WALK_JOBS $WALK_VERBOSE $WALK_DEPTH $WALK_PARENTS" > $1.env
+`)
+	t.Setenv(EnvDepth, "")
+
+	plan := newPlan()
+	plan.NewTarget = NewTarget(TargetOptions{
+		WorkingDir: dir,
+		Stdout:     new(syncBuffer),
+		Jobs:       4,
+		State:      FindState(dir),
+	})
+	err := plan.Plan(ctx, "all")
+	assert.NoError(t, err)
+	err = plan.Exec(ctx, NewSemaphore(4))
+	assert.NoError(t, err)
+
+	path := filepath.Join(dir, "lib", "lib.a")
+	for _, phase := range []string{PhaseDeps, PhaseExec} {
+		raw, err := os.ReadFile(filepath.Join(dir, "lib", phase+".env"))
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("%d %s lib/lib.a %s 4 0 0 all\n", WalkProtocol, dir, path), string(raw))
+	}
+
+	// Walkfiles executed by a nested walk are one level deeper.
+	t.Setenv(EnvDepth, "0")
+	assert.Equal(t, 1, currentDepth())
+}
+
+func TestPlan_Mtime(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  out.txt)
+    case $1 in
+      deps) echo in.txt ;;
+      exec) cp in.txt out.txt ;;
+    esac ;;
+esac
+`)
+	writeFile(t, filepath.Join(dir, "in.txt"), "a\n")
+
+	exec := func() string {
+		b := new(syncBuffer)
+		plan := newPlan()
+		plan.NewTarget = NewTarget(TargetOptions{
+			WorkingDir: dir,
+			Stdout:     b,
+		})
+		plan.Checker = new(mtimeChecker)
+		err := plan.Plan(ctx, "out.txt")
+		assert.NoError(t, err)
+		err = plan.Exec(ctx, NewSemaphore(1))
+		assert.NoError(t, err)
+		return b.String()
+	}
+
+	assert.Equal(t, "skip\tin.txt\nok\tout.txt\n", exec())
+	assert.Equal(t, "skip\tin.txt\nskip\tout.txt\n", exec())
+
+	// Dependency is newer.
+	past := time.Now().Add(-time.Hour)
+	err := os.Chtimes(filepath.Join(dir, "out.txt"), past, past)
+	assert.NoError(t, err)
+	assert.Equal(t, "skip\tin.txt\nok\tout.txt\n", exec())
+	assert.Equal(t, "skip\tin.txt\nskip\tout.txt\n", exec())
+}
+
+func TestPlan_Mtime_Task(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  out.txt)
+    case $1 in
+      deps) echo generate ;;
+      exec) echo out > out.txt ;;
+    esac ;;
+esac
+`)
+
+	exec := func() string {
+		b := new(syncBuffer)
+		plan := newPlan()
+		plan.NewTarget = NewTarget(TargetOptions{
+			WorkingDir: dir,
+			Stdout:     b,
+		})
+		plan.Checker = new(mtimeChecker)
+		err := plan.Plan(ctx, "out.txt")
+		assert.NoError(t, err)
+		err = plan.Exec(ctx, NewSemaphore(1))
+		assert.NoError(t, err)
+		return b.String()
+	}
+
+	// The task doesn't exist on disk, so it's always executed, along with
+	// the targets that depend on it.
+	assert.Equal(t, "ok\tgenerate\nok\tout.txt\n", exec())
+	assert.Equal(t, "ok\tgenerate\nok\tout.txt\n", exec())
+}
+
+func TestPlan_OutputCache(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  out.txt)
+    case $1 in
+      deps)
+        echo "output out.txt" >> "$WALK_DECLARE"
+        echo in.txt
+        ;;
+      exec) echo run >> runs && cp in.txt out.txt ;;
+    esac ;;
+esac
+`)
+	writeFile(t, filepath.Join(dir, "in.txt"), "a\n")
+
+	cacheDir := t.TempDir()
+	cache := NewDirCache(cacheDir)
+	exec := func() string {
+		b := new(syncBuffer)
+		plan := newPlan()
+		plan.NewTarget = NewTarget(TargetOptions{
+			WorkingDir: dir,
+			Stdout:     b,
+		})
+		plan.OutputCache = NewOutputCache(cache, dir)
+		err := plan.Plan(ctx, "out.txt")
+		assert.NoError(t, err)
+		err = plan.Exec(ctx, NewSemaphore(1))
+		assert.NoError(t, err)
+		return b.String()
+	}
+	out := func() string {
+		raw, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+		assert.NoError(t, err)
+		return string(raw)
+	}
+
+	assert.Equal(t, "ok\tin.txt\nok\tout.txt\n", exec())
+	assert.Equal(t, "a\n", out())
+
+	// Restored from the cache.
+	assert.NoError(t, os.Remove(filepath.Join(dir, "out.txt")))
+	assert.Equal(t, "ok\tin.txt\ncached\tout.txt\n", exec())
+	assert.Equal(t, "a\n", out())
+
+	// Dependency changed.
+	writeFile(t, filepath.Join(dir, "in.txt"), "b\n")
+	assert.Equal(t, "ok\tin.txt\nok\tout.txt\n", exec())
+	assert.Equal(t, "b\n", out())
+
+	// Dependency changed back.
+	writeFile(t, filepath.Join(dir, "in.txt"), "a\n")
+	assert.Equal(t, "ok\tin.txt\ncached\tout.txt\n", exec())
+	assert.Equal(t, "a\n", out())
+
+	// Output is corrupt in the cache, so it's executed, and the cache is
+	// repaired.
+	writeFile(t, filepath.Join(cacheDir, CacheCAS, hashBytes([]byte("a\n"))), "corrupt\n")
+	assert.NoError(t, os.Remove(filepath.Join(dir, "out.txt")))
+	assert.Equal(t, "ok\tin.txt\nok\tout.txt\n", exec())
+	assert.Equal(t, "a\n", out())
+	assert.NoError(t, os.Remove(filepath.Join(dir, "out.txt")))
+	assert.Equal(t, "ok\tin.txt\ncached\tout.txt\n", exec())
+	assert.Equal(t, "a\n", out())
+
+	raw, err := os.ReadFile(filepath.Join(dir, "runs"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(raw), "run"))
+}
+
+func TestPlan_OutputCache_TransitiveDependency(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  mid.txt)
+    case $1 in
+      deps) echo in.txt ;;
+      exec) head -1 in.txt > mid.txt ;;
+    esac ;;
+  out.txt)
+    case $1 in
+      deps)
+        echo "output out.txt" >> "$WALK_DECLARE"
+        echo mid.txt
+        echo in.txt
+        ;;
+      exec) cat mid.txt in.txt > out.txt ;;
+    esac ;;
+esac
+`)
+	writeFile(t, filepath.Join(dir, "in.txt"), "a\nb\n")
+
+	cache := NewDirCache(t.TempDir())
+	exec := func() string {
+		b := new(syncBuffer)
+		plan := newPlan()
+		plan.NewTarget = NewTarget(TargetOptions{
+			WorkingDir: dir,
+			Stdout:     b,
+		})
+		plan.OutputCache = NewOutputCache(cache, dir)
+		err := plan.Plan(ctx, "out.txt")
+		assert.NoError(t, err)
+		err = plan.Exec(ctx, NewSemaphore(1))
+		assert.NoError(t, err)
+		return b.String()
+	}
+
+	assert.Equal(t, "ok\tin.txt\nok\tmid.txt\nok\tout.txt\n", exec())
+
+	// in.txt is also a dependency of mid.txt, whose contents don't change,
+	// but it's part of the action key of out.txt, which declared it too.
+	writeFile(t, filepath.Join(dir, "in.txt"), "a\nc\n")
+	assert.Equal(t, "ok\tin.txt\nok\tmid.txt\nok\tout.txt\n", exec())
+
+	raw, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a\na\nc\n", string(raw))
+}
+
+func TestPlan_DryRun(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  all)
+    case $1 in
+      deps) echo out.txt ;;
+    esac ;;
+  out.txt)
+    case $1 in
+      deps) echo in.txt ;;
+      exec) cp in.txt out.txt ;;
+    esac ;;
+esac
+`)
+	writeFile(t, filepath.Join(dir, "in.txt"), "a\n")
+
+	newPlan := func(checker Checker) *Plan {
+		plan := newPlan()
+		plan.NewTarget = NewTarget(TargetOptions{
+			WorkingDir: dir,
+			Stdout:     io.Discard,
+		})
+		plan.Checker = checker
+		err := plan.Plan(ctx, "all")
+		assert.NoError(t, err)
+		return plan
+	}
+	dryRun := func(checker Checker) string {
+		b := new(syncBuffer)
+		err := newPlan(checker).DryRun(b)
+		assert.NoError(t, err)
+		return b.String()
+	}
+
+	assert.Equal(t, "in.txt\nout.txt\nall\n", dryRun(nil))
+	assert.Equal(t, "out.txt\ttarget does not exist\nall\tdependency out.txt would be executed\n", dryRun(new(mtimeChecker)))
+
+	// Nothing was executed.
+	_, err := os.Stat(filepath.Join(dir, "out.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	err = newPlan(new(mtimeChecker)).Exec(ctx, NewSemaphore(0))
+	assert.NoError(t, err)
+	assert.Equal(t, "all\ttarget does not exist\n", dryRun(new(mtimeChecker)))
+
+	// Out of date dependencies cause their dependents to be executed.
+	past := time.Now().Add(-time.Hour)
+	err = os.Chtimes(filepath.Join(dir, "out.txt"), past, past)
+	assert.NoError(t, err)
+	in, err := os.Stat(filepath.Join(dir, "in.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "out.txt\tdependency in.txt is newer ("+formatTime(in.ModTime())+" > "+formatTime(past)+")\nall\tdependency out.txt would be executed\n", dryRun(new(mtimeChecker)))
+}
+
+func TestPlan_DryRun_MissingDependency(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  mid.txt)
+    case $1 in
+      deps) echo in.txt ;;
+      exec) cp in.txt mid.txt ;;
+    esac ;;
+  out.txt)
+    case $1 in
+      deps) echo mid.txt ;;
+      exec) cp mid.txt out.txt ;;
+    esac ;;
+esac
+`)
+	writeFile(t, filepath.Join(dir, "in.txt"), "a\n")
+
+	newPlan := func(stdout io.Writer) *Plan {
+		plan := newPlan()
+		plan.NewTarget = NewTarget(TargetOptions{
+			WorkingDir: dir,
+			Stdout:     stdout,
+		})
+		plan.Checker = new(mtimeChecker)
+		err := plan.Plan(ctx, "out.txt")
+		assert.NoError(t, err)
+		return plan
+	}
+
+	err := newPlan(io.Discard).Exec(ctx, NewSemaphore(0))
+	assert.NoError(t, err)
+
+	// A dependency that doesn't exist is executed, which causes its
+	// dependents to be executed, like Exec does.
+	assert.NoError(t, os.Remove(filepath.Join(dir, "mid.txt")))
+	b := new(syncBuffer)
+	err = newPlan(io.Discard).DryRun(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "mid.txt\ttarget does not exist\nout.txt\tdependency mid.txt would be executed\n", b.String())
+
+	b.Reset()
+	err = newPlan(b).Exec(ctx, NewSemaphore(0))
+	assert.NoError(t, err)
+	assert.Equal(t, "skip\tin.txt\nok\tmid.txt\nok\tout.txt\n", b.String())
+}
+
+func TestPlan_DryRun_OutputCache(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  all)
+    case $1 in
+      deps) echo out.txt ;;
+    esac ;;
+  out.txt)
+    case $1 in
+      deps)
+        echo "output out.txt" >> "$WALK_DECLARE"
+        echo in.txt
+        ;;
+      exec) cp in.txt out.txt ;;
+    esac ;;
+esac
+`)
+	writeFile(t, filepath.Join(dir, "in.txt"), "a\n")
+
+	cache := NewDirCache(t.TempDir())
+	newPlan := func() *Plan {
+		plan := newPlan()
+		plan.NewTarget = NewTarget(TargetOptions{
+			WorkingDir: dir,
+			Stdout:     io.Discard,
+		})
+		plan.Checker = new(mtimeChecker)
+		plan.OutputCache = NewOutputCache(cache, dir)
+		err := plan.Plan(ctx, "all")
+		assert.NoError(t, err)
+		return plan
+	}
+	dryRun := func() string {
+		b := new(syncBuffer)
+		err := newPlan().DryRun(b)
+		assert.NoError(t, err)
+		return b.String()
+	}
+
+	assert.Equal(t, "out.txt\ttarget does not exist\nall\tdependency out.txt would be executed\n", dryRun())
+
+	err := newPlan().Exec(ctx, NewSemaphore(0))
+	assert.NoError(t, err)
+
+	// The output would be restored, rather than executed.
+	assert.NoError(t, os.Remove(filepath.Join(dir, "out.txt")))
+	assert.Equal(t, "all\tdependency out.txt would be restored from the output cache\n", dryRun())
+
+	b := new(syncBuffer)
+	err = newPlan().Why(b, "out.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "out.txt: outputs would be restored from the output cache\n", b.String())
+}
+
+func TestPlan_Explain(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  all)
+    case $1 in
+      deps) echo out.txt ;;
+    esac ;;
+  out.txt)
+    case $1 in
+      deps) echo in.txt ;;
+      exec) cp in.txt out.txt ;;
+    esac ;;
+esac
+`)
+	writeFile(t, filepath.Join(dir, "in.txt"), "a\n")
+
+	state := newState(dir)
+	newPlan := func(w io.Writer) *Plan {
+		plan := newPlan()
+		plan.NewTarget = NewTarget(TargetOptions{
+			WorkingDir: dir,
+			Stdout:     w,
+		})
+		plan.Checker = newHashChecker(state)
+		plan.State = state
+		plan.Explain = true
+		plan.RecordBuilds = true
+		err := plan.Plan(ctx, "all")
+		assert.NoError(t, err)
+		return plan
+	}
+	why := func(targets ...string) string {
+		b := new(syncBuffer)
+		err := newPlan(io.Discard).Why(b, targets...)
+		assert.NoError(t, err)
+		return b.String()
+	}
+
+	assert.Equal(t, "in.txt: no recorded state\n  no recorded execution\nout.txt: dependency in.txt would be executed\n  no recorded execution\n", why("in.txt", "out.txt"))
+
+	// Builds are only recorded when asked.
+	plan := newPlan(io.Discard)
+	plan.RecordBuilds = false
+	err := plan.Exec(ctx, NewSemaphore(0))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(state.Dir, buildRecordKind))
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, os.Remove(filepath.Join(dir, "out.txt")))
+
+	b := new(syncBuffer)
+	err = newPlan(b).Exec(ctx, NewSemaphore(0))
+	assert.NoError(t, err)
+	assert.Contains(t, b.String(), "explain\tout.txt\ttarget does not exist\n")
+
+	assert.Regexp(t, `^out.txt: up to date\n  last executed at .*, took .* \(ok\), because: target does not exist\n$`, why("out.txt"))
+
+	// Without Explain, the reason isn't recorded.
+	assert.NoError(t, os.Remove(filepath.Join(dir, "out.txt")))
+	plan = newPlan(io.Discard)
+	plan.Explain = false
+	err = plan.Exec(ctx, NewSemaphore(0))
+	assert.NoError(t, err)
+	assert.Regexp(t, `^out.txt: up to date\n  last executed at .*, took .* \(ok\)\n$`, why("out.txt"))
+
+	writeFile(t, filepath.Join(dir, "in.txt"), "b\n")
+	assert.Regexp(t, `^in.txt: target changed \(\w+ -> \w+\)\n`, why("in.txt"))
+	assert.Regexp(t, `^all: dependency out.txt would be executed\n`, why("all"))
+
+	err = newPlan(io.Discard).Why(io.Discard, "unknown")
+	assert.Error(t, err)
+}
+
 func TestPlan_Error(t *testing.T) {
 	clean(t)
 
-	b := new(bytes.Buffer)
+	b := new(syncBuffer)
 	plan := newPlan()
 	plan.NewTarget = NewTarget(TargetOptions{
 		Stdout: b,
@@ -93,10 +825,513 @@ func TestPlan_Error(t *testing.T) {
 	assert.Equal(t, "error\ttest/000-cancel/fail\texit status 1\n", b.String())
 }
 
+func TestPlan_Skipped(t *testing.T) {
+	clean(t)
+
+	b := new(syncBuffer)
+	plan := newPlan()
+	plan.NewTarget = NewTarget(TargetOptions{
+		Stdout: b,
+	})
+	err := plan.Plan(ctx, "test/000-cancel/depends-on-fail")
+	assert.NoError(t, err)
+
+	err = plan.Exec(ctx, NewSemaphore(1))
+	assert.Error(t, err)
+
+	// Dependents of the failed target are reported, but independent
+	// targets are still executed.
+	werr := err.(*WalkError)
+	assert.Equal(t, []string{"test/000-cancel/fail"}, keys(werr.Errors))
+	assert.Equal(t, map[string]string{"test/000-cancel/depends-on-fail": "test/000-cancel/fail"}, werr.Skipped)
+	assert.Equal(t, "1 target failed, 1 skipped", err.Error())
+	assert.Contains(t, b.String(), "ok\ttest/000-cancel/ok\n")
+	assert.Contains(t, b.String(), "skip\ttest/000-cancel/depends-on-fail\tdependency test/000-cancel/fail failed\n")
+}
+
+func TestPlan_Retries(t *testing.T) {
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  flaky)
+    case $1 in
+      deps) echo "retries 2" >> "$WALK_DECLARE" ;;
+      exec)
+        echo x >> attempts
+        [ $(wc -l < attempts) -ge 3 ] ;;
+    esac ;;
+  broken)
+    case $1 in
+      exec) exit 1 ;;
+    esac ;;
+  all)
+    case $1 in
+      deps) echo flaky; echo broken ;;
+    esac ;;
+esac
+`)
+
+	exec := func(retries int, target string) (string, error) {
+		b := new(syncBuffer)
+		plan := newPlan()
+		plan.NewTarget = NewTarget(TargetOptions{
+			WorkingDir: dir,
+			Stdout:     b,
+		})
+		plan.Retries = retries
+		err := plan.Plan(ctx, target)
+		assert.NoError(t, err)
+		err = plan.Exec(ctx, NewSemaphore(0))
+		return b.String(), err
+	}
+
+	// The declared number of retries overrides the default.
+	out, err := exec(0, "flaky")
+	assert.NoError(t, err)
+	assert.Equal(t, "retry\tflaky\tattempt 1/3: exit status 1\nretry\tflaky\tattempt 2/3: exit status 1\nok\tflaky\tattempt 3/3\n", out)
+
+	out, err = exec(1, "broken")
+	assert.Equal(t, "retry\tbroken\tattempt 1/2: exit status 1\nerror\tbroken\texit status 1\n", out)
+	assert.Equal(t, map[string]int{"broken": 2}, err.(*WalkError).Attempts)
+	assert.Equal(t, "1 target failed (broken after 2 attempts)", err.Error())
+
+	// Targets that succeeded after being retried are also summarized.
+	assert.NoError(t, os.Remove(filepath.Join(dir, "attempts")))
+	_, err = exec(1, "all")
+	assert.Equal(t, map[string]int{"flaky": 3}, err.(*WalkError).Retried)
+	assert.Equal(t, "1 target failed (broken after 2 attempts, flaky succeeded after 3 attempts), 1 skipped", err.Error())
+}
+
+func TestPlan_Retries_Release(t *testing.T) {
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = 100 * time.Millisecond
+
+	// Each target only succeeds once the other has been attempted, so the
+	// first to be executed is retried, and the other can only be executed
+	// while the first waits if it released its slot.
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+other() { [ "$1" = a ] && echo b || echo a; }
+case $2 in
+  a|b)
+    case $1 in
+      exec) touch $2.tried; [ -e $(other $2).tried ] ;;
+    esac ;;
+  all)
+    case $1 in
+      deps) echo a; echo b ;;
+    esac ;;
+esac
+`)
+
+	b, warnings := new(syncBuffer), new(syncBuffer)
+	plan := newPlan()
+	plan.NewTarget = NewTarget(TargetOptions{
+		WorkingDir: dir,
+		Stdout:     b,
+	})
+	plan.Retries = 1
+	plan.Warnings = warnings
+	err := plan.Plan(ctx, "all")
+	assert.NoError(t, err)
+
+	err = plan.Exec(ctx, NewSemaphore(1))
+	assert.NoError(t, err)
+
+	// Targets that succeeded after being retried are printed as a warning.
+	assert.Regexp(t, "^warning: 1 target succeeded after being retried \\([ab] after 2 attempts\\)\n$", warnings.String())
+}
+
+func TestPlan_Timeout(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  hang)
+    case $1 in
+      deps) echo "timeout 100ms" >> "$WALK_DECLARE" ;;
+      exec) echo hanging; sleep 60; echo done ;;
+    esac ;;
+  slow)
+    case $1 in
+      exec) sleep 60 ;;
+    esac ;;
+esac
+`)
+
+	exec := func(ctx context.Context, target string) (string, error) {
+		b := new(syncBuffer)
+		plan := newPlan()
+		plan.NewTarget = NewTarget(TargetOptions{
+			WorkingDir: dir,
+			Stdout:     b,
+		})
+		err := plan.Plan(ctx, target)
+		assert.NoError(t, err)
+		err = plan.Exec(ctx, NewSemaphore(0))
+		return b.String(), err
+	}
+
+	// The sleep is a child of the Walkfile, which holds stdout open, so
+	// this only returns early if the whole process tree is killed.
+	start := time.Now()
+	out, err := exec(ctx, "hang")
+	assert.Less(t, time.Since(start), 10*time.Second)
+	assert.Equal(t, "timeout\thang\ttimed out after 100ms\n", out)
+	assert.Equal(t, []string{"hang"}, keys(err.(*WalkError).TimedOut))
+	assert.Equal(t, "1 target failed (1 timed out)", err.Error())
+
+	ctx, cancel := withTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	out, err = exec(ctx, "slow")
+	assert.Equal(t, "timeout\tslow\ttimed out after 100ms\n", out)
+	assert.Equal(t, []string{"slow"}, keys(err.(*WalkError).TimedOut))
+}
+
+func TestPlan_GracePeriod(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  graceful)
+    case $1 in
+      exec) trap 'echo stopping; exit 1' TERM; sleep 60 & wait ;;
+    esac ;;
+  stubborn)
+    case $1 in
+      exec) trap '' TERM; sleep 60 ;;
+    esac ;;
+esac
+`)
+
+	exec := func(target string) (string, error) {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+
+		b := new(syncBuffer)
+		plan := newPlan()
+		plan.NewTarget = NewTarget(TargetOptions{
+			WorkingDir:  dir,
+			Stdout:      b,
+			Verbose:     true,
+			GracePeriod: 500 * time.Millisecond,
+		})
+		err := plan.Plan(ctx, target)
+		assert.NoError(t, err)
+		err = plan.Exec(ctx, NewSemaphore(0))
+		return b.String(), err
+	}
+
+	// The Walkfile handles SIGTERM, and the sleep exits because it's in
+	// the same process group.
+	start := time.Now()
+	out, err := exec("graceful")
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.True(t, strings.Contains(out, "graceful\tstopping\n"), out)
+	assert.True(t, strings.Contains(err.(*WalkError).Errors["graceful"].Error(), "exit status 1"))
+
+	// SIGTERM is ignored, so everything is killed after the grace period.
+	start = time.Now()
+	_, err = exec("stubborn")
+	assert.Greater(t, time.Since(start), 500*time.Millisecond)
+	assert.Less(t, time.Since(start), 10*time.Second)
+	assert.True(t, strings.Contains(err.(*WalkError).Errors["stubborn"].Error(), "signal: killed"))
+}
+
+func TestPlan_Interactive(t *testing.T) {
+	// The paused output is spilled to a file.
+	defer func(max int) { maxConsoleBuffer = max }(maxConsoleBuffer)
+	maxConsoleBuffer = 8
+
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  all)
+    case $1 in
+      deps) echo deploy; echo noisy ;;
+    esac ;;
+  deploy)
+    case $1 in
+      deps) echo interactive >> "$WALK_DECLARE" ;;
+      exec) read -p "Continue? " answer; sleep 0.5; echo "$answer" ;;
+    esac ;;
+  noisy)
+    case $1 in
+      exec) sleep 0.1; echo noise ;;
+    esac ;;
+esac
+`)
+
+	b := new(syncBuffer)
+	plan := newPlan()
+	plan.NewTarget = NewTarget(TargetOptions{
+		WorkingDir: dir,
+		Stdout:     b,
+		Stderr:     b,
+		Stdin:      strings.NewReader("yes\n"),
+		Verbose:    true,
+	})
+	err := plan.Plan(ctx, "all")
+	assert.NoError(t, err)
+	err = plan.Exec(ctx, NewSemaphore(0))
+	assert.NoError(t, err)
+
+	// The interactive target reads stdin, and its output isn't prefixed.
+	// The output of the other target is paused until it's done.
+	assert.Equal(t, "yes\nnoisy\tnoise\nok\tnoisy\nok\tdeploy\nok\tall\n", b.String())
+}
+
+func TestPlan_Lock(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $1 in
+  exec) echo $2 >> runs ;;
+esac
+`)
+
+	// Another walk is executing the target.
+	state := newState(dir)
+	unlock, err := state.lock(ctx, filepath.Join(dir, "shared"), func() {})
+	assert.NoError(t, err)
+
+	b := new(syncBuffer)
+	other := make(chan struct{})
+	plan := newPlan()
+	plan.NewTarget = NewTarget(TargetOptions{
+		WorkingDir: dir,
+		Stdout:     &notifyWriter{Writer: b, line: "ok\tother\n", c: other},
+		State:      state,
+	})
+	plan.State = state
+	err = plan.Plan(ctx, "shared", "other")
+	assert.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		done <- plan.Exec(ctx, NewSemaphore(1))
+	}()
+
+	// The target isn't executed until the lock is released, and it doesn't
+	// hold the only slot while it waits.
+	select {
+	case <-other:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the other target")
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, "runs"))
+	assert.NoError(t, err)
+	assert.Equal(t, "other\n", string(raw))
+
+	unlock()
+	assert.NoError(t, <-done)
+	assert.Contains(t, b.String(), "waiting\tshared\tlock is held by another walk\n")
+	assert.True(t, strings.HasSuffix(b.String(), "ok\tshared\n"), b.String())
+
+	raw, err = os.ReadFile(filepath.Join(dir, "runs"))
+	assert.NoError(t, err)
+	assert.Equal(t, "other\nshared\n", string(raw))
+
+	// Lock files are removed once the targets are executed.
+	entries, err := os.ReadDir(filepath.Join(state.Dir, LocksDir))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestPlan_Lock_UpToDate(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $1 in
+  exec) echo $2 >> runs; touch $2 ;;
+esac
+`)
+
+	// Another walk is executing the target.
+	state := newState(dir)
+	unlock, err := state.lock(ctx, filepath.Join(dir, "shared"), func() {})
+	assert.NoError(t, err)
+
+	b := new(syncBuffer)
+	waiting := make(chan struct{})
+	plan := newPlan()
+	plan.NewTarget = NewTarget(TargetOptions{
+		WorkingDir: dir,
+		Stdout:     &notifyWriter{Writer: b, line: "waiting\tshared\tlock is held by another walk\n", c: waiting},
+		State:      state,
+	})
+	plan.State = state
+	plan.Checker = new(mtimeChecker)
+	err = plan.Plan(ctx, "shared")
+	assert.NoError(t, err)
+
+	done := make(chan error)
+	go func() {
+		done <- plan.Exec(ctx, NewSemaphore(1))
+	}()
+
+	// The other walk finishes executing the target, so it's up to date once
+	// this one acquires the lock.
+	select {
+	case <-waiting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the lock")
+	}
+	writeFile(t, filepath.Join(dir, "shared"), "")
+	unlock()
+
+	assert.NoError(t, <-done)
+	assert.Contains(t, b.String(), "skip\tshared\n")
+	_, err = os.Stat(filepath.Join(dir, "runs"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestState_Lock(t *testing.T) {
+	state := newState(t.TempDir())
+	unlock, err := state.lock(ctx, "target", func() {})
+	assert.NoError(t, err)
+
+	// Another walk waits for the lock, and gets it once it's released, even
+	// though the lock file that it opened was removed.
+	waiting := make(chan struct{})
+	locked := make(chan func())
+	go func() {
+		unlock, err := state.lock(ctx, "target", func() { close(waiting) })
+		assert.NoError(t, err)
+		locked <- unlock
+	}()
+	<-waiting
+	unlock()
+	unlock = <-locked
+
+	// So a third walk still has to wait for it.
+	tctx, cancel := context.WithTimeout(ctx, 3*lockPollInterval)
+	defer cancel()
+	_, err = state.lock(tctx, "target", func() {})
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	unlock()
+	unlock, err = state.lock(ctx, "target", func() {})
+	assert.NoError(t, err)
+	unlock()
+}
+
+func TestPlan_Hook(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  all)
+    case $1 in
+      deps) echo fail ;;
+    esac ;;
+  fail)
+    case $1 in
+      exec) exit 1 ;;
+    esac ;;
+  pass)
+    case $1 in
+      exec) touch pass ;;
+    esac ;;
+esac
+`)
+	writeFile(t, filepath.Join(dir, "hook"), `#!/bin/bash
+case $1 in
+  start) echo "$1 $2 $3 $WALK_TARGET_PATH" ;;
+  finish) [[ $4 =~ ^[0-9]+$ ]] && echo "$1 $2 $3 $5 $WALK_TARGET_PATH ${SECRET:-unset}" ;;
+esac >> "$(dirname "$0")/hooks"
+`)
+	t.Setenv("SECRET", "hunter2")
+
+	b := new(syncBuffer)
+	newTarget := NewTarget(TargetOptions{
+		WorkingDir: dir,
+		Stdout:     b,
+		Stderr:     b,
+		Hook:       filepath.Join(dir, "hook"),
+		Hermetic:   true,
+		Env:        []string{"PATH"},
+	})
+	plan := newPlan()
+	plan.NewTarget = newTarget
+	err := plan.Plan(ctx, "all")
+	assert.NoError(t, err)
+	err = plan.Exec(ctx, NewSemaphore(1))
+	assert.Error(t, err)
+
+	// Targets that aren't executed only execute the hook when they finish,
+	// and the hook is executed with the hermetic environment.
+	raw, err := os.ReadFile(filepath.Join(dir, "hooks"))
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("start fail exec %[1]s/fail\nfinish fail exec error %[1]s/fail unset\nfinish all exec skip %[1]s/all unset\n", dir), string(raw))
+
+	// Including targets that are up to date.
+	os.Remove(filepath.Join(dir, "hooks"))
+	for i := 0; i < 2; i++ {
+		plan = newPlan()
+		plan.NewTarget = newTarget
+		plan.Checker = newHashChecker(FindState(dir))
+		err = plan.Plan(ctx, "pass")
+		assert.NoError(t, err)
+		err = plan.Exec(ctx, NewSemaphore(1))
+		assert.NoError(t, err)
+	}
+	raw, err = os.ReadFile(filepath.Join(dir, "hooks"))
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("start pass exec %[1]s/pass\nfinish pass exec ok %[1]s/pass unset\nfinish pass exec skip %[1]s/pass unset\n", dir), string(raw))
+
+	// Hooks that fail don't fail the target.
+	writeFile(t, filepath.Join(dir, "hook"), "#!/bin/bash\nexit 1\n")
+	b.Reset()
+	plan = newPlan()
+	plan.NewTarget = newTarget
+	err = plan.Plan(ctx, "pass")
+	assert.NoError(t, err)
+	err = plan.Exec(ctx, NewSemaphore(1))
+	assert.NoError(t, err)
+	assert.Equal(t, "pass\twarning: start hook failed: exit status 1\nok\tpass\npass\twarning: finish hook failed: exit status 1\n", b.String())
+}
+
+func TestPlan_Hook_Background(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  b)
+    case $1 in
+      deps) echo a ;;
+      exec) [ -e hooked ] && echo late > b || echo early > b ;;
+    esac ;;
+esac
+`)
+	writeFile(t, filepath.Join(dir, "hook"), `#!/bin/bash
+[ "$1 $2 $5" = "finish a skip" ] && sleep 0.5 && touch "$(dirname "$0")/hooked"
+exit 0
+`)
+	writeFile(t, filepath.Join(dir, "a"), "")
+
+	plan := newPlan()
+	plan.NewTarget = NewTarget(TargetOptions{
+		WorkingDir: dir,
+		Stdout:     io.Discard,
+		Hook:       filepath.Join(dir, "hook"),
+	})
+	plan.Checker = new(mtimeChecker)
+	err := plan.Plan(ctx, "b")
+	assert.NoError(t, err)
+	err = plan.Exec(ctx, NewSemaphore(1))
+	assert.NoError(t, err)
+
+	// The hook of the target that was up to date didn't hold up its
+	// dependent, but Exec waited for it.
+	raw, err := os.ReadFile(filepath.Join(dir, "b"))
+	assert.NoError(t, err)
+	assert.Equal(t, "early\n", string(raw))
+	_, err = os.Stat(filepath.Join(dir, "hooked"))
+	assert.NoError(t, err)
+}
+
 func TestPlan_NoWalkfile(t *testing.T) {
 	clean(t)
 
-	b := new(bytes.Buffer)
+	b := new(syncBuffer)
 	plan := newPlan()
 	plan.NewTarget = NewTarget(TargetOptions{
 		Stdout: b,
@@ -113,7 +1348,7 @@ func TestPlan_NoWalkfile(t *testing.T) {
 }
 
 func TestPrefixWriter(t *testing.T) {
-	b := new(bytes.Buffer)
+	b := new(syncBuffer)
 	w := &prefixWriter{w: b, prefix: []byte("prefix: ")}
 
 	// Lines are buffered until a newline.
@@ -161,6 +1396,73 @@ prefix: to do the job in dark, airless conditions?
 `, b.String())
 }
 
+// depsTarget is a Target implementation with a static list of dependencies.
+type depsTarget struct {
+	testTarget
+	deps   []string
+	called func()
+}
+
+func (t *depsTarget) Dependencies(_ context.Context) ([]string, error) {
+	t.called()
+	return t.deps, nil
+}
+
+func keys(m map[string]error) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// syncBuffer is a bytes.Buffer that targets that are executed concurrently can
+// write to.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.b.Reset()
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// notifyWriter is an io.Writer that closes c once line is written to it.
+type notifyWriter struct {
+	io.Writer
+	line string
+	c    chan struct{}
+	once sync.Once
+}
+
+func (w *notifyWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if string(p) == w.line {
+		w.once.Do(func() { close(w.c) })
+	}
+	return n, err
+}
+
+func writeFile(t testing.TB, path, content string) {
+	err := os.WriteFile(path, []byte(content), 0755)
+	assert.NoError(t, err)
+}
+
 func clean(t testing.TB) {
 	err := Exec(ctx, NewSemaphore(0), "test/clean")
 	assert.NoError(t, err)
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Pools is a set of named pools of weighted slots (e.g. "docker=2", or
+// "mem=16"), which limit how many targets can use a resource concurrently.
+// Targets declare how many units of each pool they use. Pools implements the
+// flag.Value interface, so that pools can be configured with repeated flags.
+type Pools struct {
+	m map[string]*pool
+}
+
+// NewPools returns an empty set of pools.
+func NewPools() *Pools {
+	return &Pools{m: make(map[string]*pool)}
+}
+
+// String implements the flag.Value interface.
+func (p *Pools) String() string {
+	if p == nil {
+		return ""
+	}
+	var pools []string
+	for name, pool := range p.m {
+		pools = append(pools, fmt.Sprintf("%s=%d", name, pool.size))
+	}
+	sort.Strings(pools)
+	return strings.Join(pools, ",")
+}
+
+// Set implements the flag.Value interface. It adds a pool with the given
+// size, in the form name=size.
+func (p *Pools) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("invalid pool %q: expected name=size", s)
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size <= 0 {
+		return fmt.Errorf("invalid pool %q: size must be a positive number", s)
+	}
+	p.m[name] = newPool(size)
+	return nil
+}
+
+// acquire waits until the given number of units of each pool are available,
+// and returns a function that releases them. Pools are acquired in order of
+// their name, so that targets waiting on the same pools can't deadlock. Pools
+// that haven't been configured are unlimited. If ctx is done before all of
+// them are acquired, the ones that were are released, and the cause of ctx is
+// returned.
+func (p *Pools) acquire(ctx context.Context, units map[string]int) (release func(), err error) {
+	var names []string
+	for name := range units {
+		if p != nil && p.m[name] != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var releases []func()
+	release = func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+
+	for _, name := range names {
+		r, err := p.m[name].acquire(ctx, units[name])
+		if err != nil {
+			release()
+			return nil, err
+		}
+		releases = append(releases, r)
+	}
+
+	return release, nil
+}
+
+// pool is a weighted semaphore.
+type pool struct {
+	mu   sync.Mutex
+	size int
+	used int
+
+	// Closed, and replaced, each time that units are released, to wake up
+	// the targets that are waiting for them.
+	released chan struct{}
+}
+
+func newPool(size int) *pool {
+	return &pool{size: size, released: make(chan struct{})}
+}
+
+// acquire waits until n units are available, or ctx is done, and returns a
+// function that releases them. Targets that use more units than the pool has
+// use the whole pool.
+func (p *pool) acquire(ctx context.Context, n int) (release func(), err error) {
+	if n > p.size {
+		n = p.size
+	}
+
+	for {
+		p.mu.Lock()
+		if p.used+n <= p.size {
+			p.used += n
+			p.mu.Unlock()
+			break
+		}
+		released := p.released
+		p.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	}
+
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.used -= n
+		close(p.released)
+		p.released = make(chan struct{})
+	}, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPools_Set(t *testing.T) {
+	pools := NewPools()
+	assert.NoError(t, pools.Set("docker=2"))
+	assert.NoError(t, pools.Set("mem=16"))
+	assert.Equal(t, "docker=2,mem=16", pools.String())
+
+	assert.Error(t, pools.Set("docker"))
+	assert.Error(t, pools.Set("=2"))
+	assert.Error(t, pools.Set("docker=0"))
+	assert.Error(t, pools.Set("docker=two"))
+}
+
+func TestPools_Acquire(t *testing.T) {
+	pools := NewPools()
+	assert.NoError(t, pools.Set("mem=4"))
+
+	// Units of unconfigured pools are unlimited, and requests for more
+	// units than the pool has use the whole pool.
+	release1, err := pools.acquire(ctx, map[string]int{"mem": 3, "cpu": 100})
+	assert.NoError(t, err)
+	release2, err := pools.acquire(ctx, map[string]int{"mem": 1})
+	assert.NoError(t, err)
+
+	acquired := make(chan struct{})
+	go func() {
+		release, err := pools.acquire(ctx, map[string]int{"mem": 8})
+		assert.NoError(t, err)
+		release()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("expected acquire to wait for units to be released")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release1()
+	select {
+	case <-acquired:
+		t.Fatal("expected acquire to wait for all units to be released")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release2()
+	<-acquired
+}
+
+func TestPools_Acquire_Cancel(t *testing.T) {
+	pools := NewPools()
+	assert.NoError(t, pools.Set("a=1"))
+	assert.NoError(t, pools.Set("b=1"))
+
+	releaseB, err := pools.acquire(ctx, map[string]int{"b": 1})
+	assert.NoError(t, err)
+	defer releaseB()
+
+	// Waiting for b stops when ctx is done, and releases a.
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := make(chan error)
+	go func() {
+		_, err := pools.acquire(ctx, map[string]int{"a": 1, "b": 1})
+		done <- err
+	}()
+	cancel(errCancelled)
+	assert.Equal(t, errCancelled, <-done)
+
+	release, err := pools.acquire(context.Background(), map[string]int{"a": 1})
+	assert.NoError(t, err)
+	release()
+}
+
+func TestPlan_Pools(t *testing.T) {
+	dir := t.TempDir()
+
+	// Each target fails if another target is using the pool at the same
+	// time.
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  all)
+    case $1 in
+      deps) echo a; echo b; echo c ;;
+    esac ;;
+  *)
+    case $1 in
+      deps) echo "pool docker" >> "$WALK_DECLARE" ;;
+      exec) mkdir lock && sleep 0.1 && rmdir lock ;;
+    esac ;;
+esac
+`)
+
+	pools := NewPools()
+	assert.NoError(t, pools.Set("docker=1"))
+
+	plan := newPlan()
+	plan.NewTarget = NewTarget(TargetOptions{
+		WorkingDir: dir,
+		Stdout:     io.Discard,
+	})
+	plan.Pools = pools
+	err := plan.Plan(ctx, "all")
+	assert.NoError(t, err)
+
+	err = plan.Exec(ctx, NewSemaphore(0))
+	assert.NoError(t, err)
+}
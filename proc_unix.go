@@ -0,0 +1,63 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// setProcessGroup starts the command in its own process group, so that when
+// its context is cancelled, any processes that it started are sent SIGTERM
+// along with it, and then SIGKILL if they haven't exited after the grace
+// period. The returned function must be called after the command has been
+// waited for. If every process in the group has exited by then, it stops the
+// timer that sends SIGKILL.
+func setProcessGroup(cmd *exec.Cmd, grace time.Duration) func() {
+	// Cancel has always returned by the time that Wait has, so kill doesn't
+	// need to be guarded.
+	var kill *time.Timer
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		pgid := -cmd.Process.Pid
+		if err := syscall.Kill(pgid, syscall.SIGTERM); err != nil {
+			return err
+		}
+		// The group is killed even if the command exits in time, since
+		// processes that it started might not have.
+		kill = time.AfterFunc(grace, func() {
+			syscall.Kill(pgid, syscall.SIGKILL)
+		})
+		return nil
+	}
+	return func() {
+		if kill == nil {
+			return
+		}
+		if err := syscall.Kill(-cmd.Process.Pid, 0); err == syscall.ESRCH {
+			kill.Stop()
+		}
+	}
+}
+
+// setForeground makes the command's process group, which must have been set
+// up by setProcessGroup, the foreground process group of the terminal when it
+// starts, so that it can read from it. The returned function must be called
+// after the command has been waited for, to make walk's process group the
+// foreground process group again.
+func setForeground(cmd *exec.Cmd, tty *os.File) func() {
+	cmd.SysProcAttr.Foreground = true
+	cmd.SysProcAttr.Ctty = int(tty.Fd())
+	return func() {
+		// Walk is in the background until this is done, so it would be
+		// stopped by SIGTTOU otherwise.
+		signal.Ignore(syscall.SIGTTOU)
+		defer signal.Reset(syscall.SIGTTOU)
+		pgrp := int32(syscall.Getpgrp())
+		syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), syscall.TIOCSPGRP, uintptr(unsafe.Pointer(&pgrp)))
+	}
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"time"
+)
+
+// setProcessGroup is a noop on windows, where only the command itself is
+// killed, immediately, when its context is cancelled.
+func setProcessGroup(cmd *exec.Cmd, grace time.Duration) func() {
+	return func() {}
+}
+
+// setForeground is a noop on windows, which doesn't have process groups that
+// the terminal is shared between.
+func setForeground(cmd *exec.Cmd, tty *os.File) func() {
+	return func() {}
+}
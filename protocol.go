@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// WalkProtocol is the version of the protocol between walk and Walkfiles: the
+// positional arguments, the environment variables below, and the directives
+// that can be declared. It's incremented by releases that change the
+// protocol, so that Walkfiles can check for the features that they need.
+const WalkProtocol = 1
+
+// These are the environment variables that are exported to Walkfiles, in
+// addition to $WALK_DECLARE.
+const (
+	// EnvProtocol is the version of the protocol (see WalkProtocol).
+	EnvProtocol = "WALK_PROTOCOL"
+
+	// EnvRoot is the absolute path to the root of the project, which is
+	// the directory that contains the state directory.
+	EnvRoot = "WALK_ROOT"
+
+	// EnvTarget is the name of the target, relative to the directory that
+	// walk was executed in (e.g. "src/hello.o").
+	EnvTarget = "WALK_TARGET"
+
+	// EnvTargetPath is the absolute path to the target.
+	EnvTargetPath = "WALK_TARGET_PATH"
+
+	// EnvJobs is the value of -j. 0 means that there's no limit.
+	EnvJobs = "WALK_JOBS"
+
+	// EnvVerbose is 1 if -v was provided, otherwise 0.
+	EnvVerbose = "WALK_VERBOSE"
+
+	// EnvDepth is how many walk processes the Walkfile is nested within,
+	// starting at 0 for a walk that wasn't executed by a Walkfile.
+	EnvDepth = "WALK_DEPTH"
+
+	// EnvParents is a space separated list of the names of the targets
+	// that depend on the target. During the deps phase, it's the target
+	// whose dependencies first included it.
+	EnvParents = "WALK_PARENTS"
+
+	// EnvSocket is the path to the socket that walks executed by the
+	// Walkfile use to join the walk that executed it, during the exec
+	// phase.
+	EnvSocket = "WALK_SOCKET"
+)
+
+// invocation describes how walk was executed, which is shared by all targets.
+type invocation struct {
+	root    string
+	jobs    uint
+	verbose bool
+	depth   int
+}
+
+// currentDepth returns the value of $WALK_DEPTH for Walkfiles executed by
+// this walk, which is one more than its own, if it was executed by a Walkfile.
+func currentDepth() int {
+	depth, err := strconv.Atoi(os.Getenv(EnvDepth))
+	if err != nil {
+		return 0
+	}
+	return depth + 1
+}
+
+// parentsKey is the context key for the names of the targets that depend on
+// the target that's being executed.
+type parentsKey struct{}
+
+// withParents returns a context that exports the given targets as the
+// parents of the target that's executed with it.
+func withParents(ctx context.Context, parents ...Target) context.Context {
+	var names []string
+	for _, t := range parents {
+		if _, ok := t.(*rootTarget); !ok {
+			names = append(names, t.Name())
+		}
+	}
+	sort.Strings(names)
+	return context.WithValue(ctx, parentsKey{}, names)
+}
+
+// protocolEnv returns the environment variables that are exported to the
+// Walkfile when executing the target.
+func (t *target) protocolEnv(ctx context.Context) []string {
+	parents, _ := ctx.Value(parentsKey{}).([]string)
+	socket, _ := ctx.Value(socketKey{}).(string)
+	verbose := 0
+	if t.invocation.verbose {
+		verbose = 1
+	}
+	return []string{
+		fmt.Sprintf("%s=%d", EnvProtocol, WalkProtocol),
+		fmt.Sprintf("%s=%s", EnvRoot, t.invocation.root),
+		fmt.Sprintf("%s=%s", EnvTarget, t.name),
+		fmt.Sprintf("%s=%s", EnvTargetPath, t.path),
+		fmt.Sprintf("%s=%d", EnvJobs, t.invocation.jobs),
+		fmt.Sprintf("%s=%d", EnvVerbose, verbose),
+		fmt.Sprintf("%s=%d", EnvDepth, t.invocation.depth),
+		fmt.Sprintf("%s=%s", EnvParents, strings.Join(parents, " ")),
+		fmt.Sprintf("%s=%s", EnvSocket, socket),
+	}
+}
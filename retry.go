@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// retryBackoff is how long to wait before retrying a target that failed for
+// the first time. The wait doubles after each subsequent attempt.
+var retryBackoff = time.Second
+
+// attempt represents an attempt at executing a target.
+type attempt struct {
+	// The attempt number, starting at 1.
+	n int
+
+	// The maximum number of attempts.
+	max int
+
+	// The cause of the cancellation of this attempt, if it times out.
+	timeout *timeoutError
+}
+
+func (a attempt) String() string {
+	return fmt.Sprintf("attempt %d/%d", a.n, a.max)
+}
+
+// retrying returns whether the target will be retried if this attempt fails.
+// Attempts that time out are retried, but attempts that are otherwise
+// cancelled are not.
+func (a attempt) retrying(ctx context.Context) bool {
+	if a.n >= a.max {
+		return false
+	}
+	if cause := timedOut(ctx); cause != nil {
+		return cause == a.timeout
+	}
+	return ctx.Err() == nil
+}
+
+// attempter is implemented by targets that report each attempt at executing
+// them.
+type attempter interface {
+	execAttempt(ctx context.Context, a attempt) error
+}
+
+// retriedError is returned when a target failed after more than one attempt.
+type retriedError struct {
+	err      error
+	attempts int
+}
+
+func (e *retriedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retriedError) Unwrap() error {
+	return e.err
+}
+
+// retries returns the number of times that the target should be retried after
+// it fails. The Walkfile can override the Plan's default by declaring it.
+func (p *Plan) retries(t Target) int {
+	if d := declared(t); d.retries != nil {
+		return *d.retries
+	}
+	return p.Retries
+}
+
+// execRetries executes the target, retrying it with an exponential backoff if
+// it fails. Between attempts, pause is called with the backoff, to wait while
+// the target doesn't hold its lock, pools, or slot in the semaphore. Targets
+// that succeed after being retried are recorded in the execution.
+func (p *Plan) execRetries(ctx context.Context, e *execution, t Target, pause func(time.Duration) error) error {
+	max := p.retries(t) + 1
+	backoff := retryBackoff
+	for n := 1; ; n++ {
+		err := p.attempt(ctx, t, attempt{n: n, max: max})
+		if err == nil {
+			if n > 1 {
+				e.retried(t, n)
+			}
+			return nil
+		}
+		if n > 1 {
+			err = &retriedError{err: err, attempts: n}
+		}
+		if n >= max || ctx.Err() != nil {
+			return err
+		}
+
+		if perr := pause(backoff); perr != nil {
+			// The target was reported as being retried, so it needs
+			// to be reported again.
+			switch {
+			case context.Cause(ctx) == errCancelled:
+				report(ctx, t, StatusCancelled, err.Error())
+			case timedOut(ctx) != nil:
+				report(ctx, t, StatusTimeout, timedOut(ctx).Error())
+			case ctx.Err() != nil:
+				report(ctx, t, StatusError, err.Error())
+			default:
+				return failed(ctx, t, perr)
+			}
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// attempt executes the target once, cancelling it if it takes longer than its
+// declared timeout.
+func (p *Plan) attempt(ctx context.Context, t Target, a attempt) error {
+	if timeout := p.timeout(t); timeout > 0 {
+		a.timeout = &timeoutError{timeout: timeout}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, timeout, a.timeout)
+		defer cancel()
+	}
+
+	var err error
+	if at, ok := t.(attempter); ok {
+		err = at.execAttempt(ctx, a)
+	} else {
+		err = t.Exec(ctx)
+	}
+	if cause := timedOut(ctx); err != nil && cause != nil {
+		return fmt.Errorf("%w: %v", cause, err)
+	}
+	return err
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// schedulerPollInterval is how often the scheduler retries acquiring a slot
+// in the Semaphore, when targets are waiting, and a slot may become available
+// for reasons other than a target finishing (e.g. the load average dropping,
+// or another process returning a token to the jobserver). See polled.
+var schedulerPollInterval = 100 * time.Millisecond
+
+// scheduler decides the order in which targets that are ready to be executed
+// acquire a slot in the Semaphore. Targets with the longest estimated critical
+// path (the time that it will take to execute the target, and everything that
+// depends on it) go first, so that long chains of targets aren't started late
+// when concurrency is limited.
+//
+// The order is applied in two places: the walk takes targets from its set of
+// ready targets with less (see WalkOptions.Less), so that when a target
+// finishes, the worker that executed it goes to the highest priority target
+// that's ready, including the dependents of the one that finished. Targets that
+// have been started, but are waiting for a slot, get one with P in the same
+// order.
+type scheduler struct {
+	semaphore Semaphore
+
+	// Maps the name of each target to its priority.
+	priorities map[string]float64
+
+	// True if the Semaphore has to be polled for slots. See polled.
+	poll bool
+
+	mu      sync.Mutex
+	waiting waiterHeap
+
+	// Set while a retry is pending.
+	retry *time.Timer
+}
+
+// newScheduler returns a scheduler for the targets in the graph. Priorities
+// are estimated from the durations recorded in state, when available. When
+// the Semaphore doesn't limit concurrency, there's nothing to prioritize.
+func newScheduler(semaphore Semaphore, g *Graph, state *State) *scheduler {
+	s := &scheduler{
+		semaphore: semaphore,
+		poll:      polled(semaphore),
+	}
+	if _, ok := semaphore.(*unlimitedSemaphore); !ok {
+		s.priorities = criticalPaths(g, durations(g, state))
+	}
+	return s
+}
+
+// polled returns true if slots in the Semaphore can become available without
+// a target releasing one, so TryP has to be retried while targets are waiting.
+// Otherwise, slots are only handed out when they're released by V.
+func polled(semaphore Semaphore) bool {
+	switch semaphore.(type) {
+	case *loadSemaphore, *jobserver:
+		return true
+	}
+	return false
+}
+
+// P waits until a slot in the Semaphore has been acquired for the target.
+// Slots are handed to waiting targets in order of priority. If ctx is done
+// first, the target stops waiting, and the cause of ctx is returned.
+func (s *scheduler) P(ctx context.Context, t Target) error {
+	w := &waiter{name: t.Name(), ready: make(chan struct{})}
+
+	s.mu.Lock()
+	w.priority = s.priorities[t.Name()]
+	heap.Push(&s.waiting, w)
+	s.next()
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-w.ready:
+		// The slot was handed to the target before it stopped
+		// waiting, so it's handed to the next one instead.
+		s.semaphore.V()
+		s.next()
+	default:
+		heap.Remove(&s.waiting, w.index)
+	}
+	return context.Cause(ctx)
+}
+
+// V releases a slot in the Semaphore, and hands it to the next waiting target.
+func (s *scheduler) V() {
+	s.semaphore.V()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next()
+}
+
+// lend releases a slot that's held by a target that's waiting on other targets
+// to be executed on its behalf (by a nested walk), so that they can use it. The
+// target must acquire a slot again with P before it continues.
+func (s *scheduler) lend() {
+	s.V()
+}
+
+// inherit raises the priority of the targets, which are being executed on
+// behalf of t, to its priority.
+func (s *scheduler) inherit(t Target, targets []Target) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.priorities == nil {
+		return
+	}
+	for _, target := range targets {
+		if p := s.priorities[t.Name()]; p > s.priorities[target.Name()] {
+			s.priorities[target.Name()] = p
+		}
+	}
+}
+
+// less returns true if a has a higher priority than b. Ties are broken by name,
+// so that the order is stable.
+func (s *scheduler) less(a, b Target) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pa, pb := s.priorities[a.Name()], s.priorities[b.Name()]
+	if pa != pb {
+		return pa > pb
+	}
+	return a.Name() < b.Name()
+}
+
+// next hands slots in the Semaphore to the highest priority waiting targets,
+// until there are no more slots available. Must be called with mu held.
+func (s *scheduler) next() {
+	for s.waiting.Len() > 0 {
+		if !s.semaphore.TryP() {
+			if s.poll {
+				s.retryAfter(schedulerPollInterval)
+			}
+			return
+		}
+		close(heap.Pop(&s.waiting).(*waiter).ready)
+	}
+}
+
+// retryAfter calls next after d, unless a retry is already pending. Must be
+// called with mu held.
+func (s *scheduler) retryAfter(d time.Duration) {
+	if s.retry != nil {
+		return
+	}
+	s.retry = time.AfterFunc(d, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.retry = nil
+		s.next()
+	})
+}
+
+// durations returns the estimated duration of each target in the graph that's
+// executed by a Walkfile. Targets whose builds were recorded (see
+// Plan.RecordBuilds) use their last recorded duration, and the rest use the
+// average of those. If nothing has been recorded, every target is estimated to
+// take the same amount of time, so the critical path falls back to the depth of
+// the target.
+func durations(g *Graph, state *State) map[string]time.Duration {
+	d := make(map[string]time.Duration)
+
+	var unknown []string
+	var total time.Duration
+	for _, t := range g.Sorted() {
+		ft, ok := t.(FileTarget)
+		if !ok || ft.RuleFile() == "" {
+			continue
+		}
+
+		var r buildRecord
+		if state != nil {
+			if ok, err := state.read(buildRecordKind, stateKey(ft.Path()), &r); err == nil && ok {
+				d[t.Name()] = r.Duration
+				total += r.Duration
+				continue
+			}
+		}
+		unknown = append(unknown, t.Name())
+	}
+
+	estimate := time.Second
+	if n := len(d); n > 0 {
+		estimate = total / time.Duration(n)
+	}
+	for _, name := range unknown {
+		d[name] = estimate
+	}
+
+	return d
+}
+
+// criticalPaths returns the length of the critical path from each target in
+// the graph to the root, given the duration of each target.
+func criticalPaths(g *Graph, durations map[string]time.Duration) map[string]float64 {
+	paths := make(map[string]float64)
+
+	sorted := g.Sorted()
+	for i := len(sorted) - 1; i >= 0; i-- {
+		t := sorted[i]
+
+		var longest float64
+		for _, dependent := range g.Dependents(t) {
+			if p := paths[dependent.Name()]; p > longest {
+				longest = p
+			}
+		}
+		paths[t.Name()] = longest + durations[t.Name()].Seconds()
+	}
+
+	return paths
+}
+
+// waiter is a target that's waiting to be scheduled.
+type waiter struct {
+	priority float64
+	name     string
+	ready    chan struct{}
+
+	// The index of the waiter in the heap, so that it can be removed.
+	index int
+}
+
+// waiterHeap implements heap.Interface for a max-heap of waiters, by priority.
+// Ties are broken by name, so that the order is stable.
+type waiterHeap []*waiter
+
+func (h waiterHeap) Len() int { return len(h) }
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].name < h[j].name
+}
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *waiterHeap) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+func (h *waiterHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
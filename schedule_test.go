@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlan_CriticalPath(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "Walkfile"), `#!/bin/bash
+case $2 in
+  all)
+    case $1 in
+      deps) echo chain3; echo x1; echo x2; echo x3 ;;
+    esac ;;
+  start)
+    case $1 in
+      exec) echo $2 >> order ;;
+    esac ;;
+  chain3)
+    case $1 in
+      deps) echo chain2 ;;
+      exec) echo $2 >> order ;;
+    esac ;;
+  chain2)
+    case $1 in
+      deps) echo chain1 ;;
+      exec) echo $2 >> order ;;
+    esac ;;
+  *)
+    case $1 in
+      deps) echo start ;;
+      exec) echo $2 >> order ;;
+    esac ;;
+esac
+`)
+	state := newState(dir)
+
+	// Executes the graph serially, and returns the order that targets were
+	// executed in. Every target depends on "start", so that they all
+	// become ready at the same time.
+	exec := func() []string {
+		os.Remove(filepath.Join(dir, "order"))
+
+		plan := newPlan()
+		plan.NewTarget = NewTarget(TargetOptions{
+			WorkingDir: dir,
+			Stdout:     io.Discard,
+		})
+		plan.State = state
+		plan.Workers = 1
+		err := plan.Plan(ctx, "all")
+		assert.NoError(t, err)
+		err = plan.Exec(ctx, NewSemaphore(1))
+		assert.NoError(t, err)
+
+		raw, err := os.ReadFile(filepath.Join(dir, "order"))
+		assert.NoError(t, err)
+		return strings.Fields(string(raw))
+	}
+
+	// Without any recorded durations, the deepest targets go first.
+	assert.Equal(t, []string{"start", "chain1", "chain2", "chain3"}, exec()[:4])
+
+	// A target that's known to be slow goes first.
+	for name, d := range map[string]time.Duration{
+		"start":  time.Second,
+		"chain1": time.Second,
+		"chain2": time.Second,
+		"chain3": time.Second,
+		"x1":     time.Second,
+		"x2":     10 * time.Second,
+		"x3":     time.Second,
+	} {
+		err := state.write(buildRecordKind, stateKey(filepath.Join(dir, name)), &buildRecord{Duration: d})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"start", "x2", "chain1", "chain2", "chain3"}, exec()[:5])
+}
+
+func TestScheduler_Poll(t *testing.T) {
+	waiting := func(s *scheduler) (polling bool) {
+		s.P(ctx, &testTarget{name: "a"})
+
+		done := make(chan struct{})
+		go func() {
+			s.P(ctx, &testTarget{name: "b"})
+			close(done)
+		}()
+
+		// Wait for b to be waiting.
+		for {
+			s.mu.Lock()
+			n := s.waiting.Len()
+			polling = s.retry != nil
+			s.mu.Unlock()
+			if n > 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		s.V()
+		<-done
+		s.V()
+		return polling
+	}
+
+	// Slots in a plain semaphore only become available when they're
+	// released, so there's nothing to poll.
+	assert.False(t, waiting(newScheduler(NewSemaphore(1), newGraph(), nil)))
+
+	load := NewLoadSemaphore(NewSemaphore(1), 1).(*loadSemaphore)
+	load.loadavg = func() (float64, error) { return 0, nil }
+	assert.True(t, waiting(newScheduler(load, newGraph(), nil)))
+}
+
+func TestScheduler_Cancel(t *testing.T) {
+	s := newScheduler(NewSemaphore(1), newGraph(), nil)
+	assert.NoError(t, s.P(ctx, &testTarget{name: "a"}))
+
+	cctx, cancel := context.WithCancel(ctx)
+	errs := make(chan error)
+	go func() {
+		errs <- s.P(cctx, &testTarget{name: "b"})
+	}()
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+
+	// The target that stopped waiting doesn't get the slot.
+	s.mu.Lock()
+	assert.Equal(t, 0, s.waiting.Len())
+	s.mu.Unlock()
+	s.V()
+	assert.NoError(t, s.P(ctx, &testTarget{name: "c"}))
+}
+
+// BenchmarkScheduler compares how long it takes to walk a graph with two
+// workers, when ready targets are started in order of their critical path,
+// against the order that they became ready in. The graph is a chain of 4
+// targets, and 8 independent targets, that each take a millisecond, so
+// starting the chain first takes 6ms, and starting it last takes 8ms.
+func BenchmarkScheduler(b *testing.B) {
+	g := newGraph()
+	root := &rootTarget{}
+	g.Add(root)
+	d := make(map[string]time.Duration)
+	for i := 1; i <= 8; i++ {
+		t := &testTarget{name: fmt.Sprintf("a%d", i)}
+		g.Add(t)
+		g.Connect(root, t)
+		d[t.Name()] = time.Millisecond
+	}
+	var prev Target
+	for i := 1; i <= 4; i++ {
+		t := &testTarget{name: fmt.Sprintf("z%d", i)}
+		g.Add(t)
+		if prev != nil {
+			g.Connect(t, prev)
+		}
+		d[t.Name()] = time.Millisecond
+		prev = t
+	}
+	g.Connect(root, prev)
+
+	s := &scheduler{priorities: criticalPaths(g, d)}
+	for _, bb := range []struct {
+		name string
+		less func(a, b Target) bool
+	}{
+		{"critical-path", s.less},
+		{"fifo", nil},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				err := g.Walk(context.Background(), func(t Target) error {
+					time.Sleep(d[t.Name()])
+					return nil
+				}, WalkOptions{Workers: 2, Less: bb.less})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,10 +1,19 @@
 package main
 
+import (
+	"sync"
+	"time"
+)
+
 // Semaphore is an interface to represent a Semaphore. This is used when
 // executing a graph to control the number of concurrent processes running.
 type Semaphore interface {
 	P()
 	V()
+
+	// TryP is like P, but returns false instead of waiting, when the
+	// Semaphore can't be acquired.
+	TryP() bool
 }
 
 // NewSemaphore returns a new Semaphore implementation that limits the level of
@@ -27,7 +36,88 @@ func (s semaphore) V() {
 	<-s
 }
 
+func (s semaphore) TryP() bool {
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
 type unlimitedSemaphore struct{}
 
-func (s *unlimitedSemaphore) P() {}
-func (s *unlimitedSemaphore) V() {}
+func (s *unlimitedSemaphore) P()         {}
+func (s *unlimitedSemaphore) V()         {}
+func (s *unlimitedSemaphore) TryP() bool { return true }
+
+// loadPollInterval is how often the load average is checked, while waiting for
+// it to drop below the limit.
+var loadPollInterval = time.Second
+
+// NewLoadSemaphore returns a Semaphore that wraps s, and additionally waits for
+// the system load average to drop below max before allowing a new process to
+// start, like make's -l flag. To avoid stalling, a process is always allowed
+// to start if no other processes are running.
+func NewLoadSemaphore(s Semaphore, max float64) Semaphore {
+	return &loadSemaphore{
+		Semaphore: s,
+		max:       max,
+		loadavg:   loadavg,
+	}
+}
+
+type loadSemaphore struct {
+	Semaphore
+	max float64
+
+	// Returns the 1 minute load average of the system.
+	loadavg func() (float64, error)
+
+	mu sync.Mutex
+
+	// The number of processes that are running.
+	running int
+}
+
+func (s *loadSemaphore) P() {
+	s.Semaphore.P()
+	for !s.acquire() {
+		time.Sleep(loadPollInterval)
+	}
+}
+
+func (s *loadSemaphore) TryP() bool {
+	if !s.Semaphore.TryP() {
+		return false
+	}
+	if !s.acquire() {
+		s.Semaphore.V()
+		return false
+	}
+	return true
+}
+
+func (s *loadSemaphore) V() {
+	s.mu.Lock()
+	s.running--
+	s.mu.Unlock()
+	s.Semaphore.V()
+}
+
+// acquire returns true if a new process can start, because the load average
+// is below the limit, or nothing else is running. If the load average can't be
+// determined, it's ignored.
+func (s *loadSemaphore) acquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running > 0 {
+		if load, err := s.loadavg(); err == nil && load >= s.max {
+			return false
+		}
+	}
+
+	s.running++
+	return true
+}
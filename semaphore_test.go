@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadSemaphore(t *testing.T) {
+	defer func(interval time.Duration) { loadPollInterval = interval }(loadPollInterval)
+	loadPollInterval = time.Millisecond
+
+	load := make(chan float64, 1)
+	load <- 4
+	s := NewLoadSemaphore(NewSemaphore(0), 2).(*loadSemaphore)
+	s.loadavg = func() (float64, error) {
+		l := <-load
+		load <- l
+		return l, nil
+	}
+
+	// Nothing else is running, so the load average is ignored.
+	s.P()
+
+	started := make(chan struct{})
+	go func() {
+		s.P()
+		close(started)
+	}()
+
+	select {
+	case <-started:
+		t.Fatal("expected P to wait for the load average to drop")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-load
+	load <- 1
+	<-started
+
+	s.V()
+	s.V()
+	assert.Equal(t, 0, s.running)
+}
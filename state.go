@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// StateDir is the name of the directory where walk(1) persists state between
+// runs.
+const StateDir = ".walk"
+
+// State represents the persistent state directory, which is used to cache
+// information between runs.
+type State struct {
+	// The root of the project, which is the directory that contains the
+	// state directory.
+	Root string
+
+	// The absolute path to the state directory.
+	Dir string
+}
+
+// FindState returns the State for the given working directory. It searches
+// the working directory, then each of its parents, for an existing state
+// directory. If one isn't found, the state directory will be created within
+// the working directory when it's first written to.
+func FindState(wd string) *State {
+	for dir := wd; ; {
+		if fi, err := os.Stat(filepath.Join(dir, StateDir)); err == nil && fi.IsDir() {
+			return newState(dir)
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	return newState(wd)
+}
+
+func newState(root string) *State {
+	return &State{
+		Root: root,
+		Dir:  filepath.Join(root, StateDir),
+	}
+}
+
+// read decodes the JSON document with the given kind and key into v. It
+// returns false if the document does not exist.
+func (s *State) read(kind, key string, v interface{}) (bool, error) {
+	raw, err := os.ReadFile(s.path(kind, key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// write encodes v as JSON, and atomically writes it to the document with the
+// given kind and key.
+func (s *State) write(kind, key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	path := s.path(kind, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, bytes.NewReader(raw), 0644)
+}
+
+func (s *State) path(kind, key string) string {
+	return filepath.Join(s.Dir, kind, key+".json")
+}
+
+// stateKey returns the key that is used to store state for the file at the
+// given absolute path.
+func stateKey(path string) string {
+	return hashBytes([]byte(path))
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// timeoutError is the cause of the cancellation of a context when a timeout
+// expires.
+type timeoutError struct {
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s", e.timeout)
+}
+
+// withTimeout returns a copy of ctx that's cancelled after the timeout, with a
+// timeoutError as the cause.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeoutCause(ctx, timeout, &timeoutError{timeout: timeout})
+}
+
+// timedOut returns the timeoutError that caused ctx to be cancelled, or nil if
+// it wasn't cancelled because of a timeout.
+func timedOut(ctx context.Context) *timeoutError {
+	var err *timeoutError
+	if errors.As(context.Cause(ctx), &err) {
+		return err
+	}
+	return nil
+}
+
+// timeout returns how long each attempt at executing the target can take, as
+// declared by the Walkfile. Zero means that there's no timeout.
+func (p *Plan) timeout(t Target) time.Duration {
+	return declared(t).timeout
+}
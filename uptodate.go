@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Checker is used to determine whether a target needs to be executed during
+// the exec phase, or if it's already up to date.
+type Checker interface {
+	// Check returns a non-empty reason if the target needs to be executed,
+	// given every dependency that it declared. An empty reason indicates
+	// that the target is up to date.
+	Check(t Target, deps []Target) (string, error)
+
+	// Record is called after the target has been executed successfully.
+	Record(t Target, deps []Target) error
+}
+
+// reasonMissing is the reason that's given by Checkers when the target does
+// not exist on disk. This is always the case for tasks, like "test".
+const reasonMissing = "target does not exist"
+
+// FileTarget is implemented by targets that represent a path on disk.
+type FileTarget interface {
+	Target
+
+	// Path returns the absolute path to the target.
+	Path() string
+
+	// RuleFile returns the path to the Walkfile that is used to build the
+	// target, or an empty string if the target is a static file.
+	RuleFile() string
+}
+
+// hashRecordKind is the kind of document, within the State directory, that
+// hash records are stored as.
+const hashRecordKind = "hashes"
+
+// hashRecord is the state that's recorded after a target is executed
+// successfully by the hashChecker.
+type hashRecord struct {
+	// Hash of the Walkfile that executed the target.
+	Walkfile string
+
+	// Maps the absolute path of each dependency to its result hash.
+	Deps map[string]string
+
+	// Hash of the environment that the Walkfile was executed with, in
+	// hermetic mode.
+	Env string `json:",omitempty"`
+
+	// The result hash of the target. For targets that produce a file, this
+	// is the hash of the file's contents. For targets that don't (e.g.
+	// tasks like "test"), it's a hash of the inputs.
+	Result string
+}
+
+// hashChecker is a Checker implementation that determines whether a target
+// is up to date, by comparing the hashes of its dependencies and Walkfile
+// against what was recorded the last time it was executed.
+//
+// Static files are hashed by their contents, and targets that are built by a
+// Walkfile are represented by the result hash that was recorded when they were
+// built. Targets that don't produce a file are always executed.
+type hashChecker struct {
+	state *State
+
+	mu sync.Mutex
+	// Memoizes the result hashes of targets in this run.
+	results map[string]string
+}
+
+func newHashChecker(state *State) *hashChecker {
+	return &hashChecker{
+		state:   state,
+		results: make(map[string]string),
+	}
+}
+
+// Check implements the Checker interface.
+func (c *hashChecker) Check(t Target, deps []Target) (string, error) {
+	ft, ok := t.(FileTarget)
+	if !ok {
+		return "not a file", nil
+	}
+
+	// Static files are never executed.
+	if ft.RuleFile() == "" {
+		return "", nil
+	}
+
+	current, err := c.inputs(ft, deps)
+	if err != nil {
+		return "", err
+	}
+
+	var r hashRecord
+	ok, err = c.state.read(hashRecordKind, stateKey(ft.Path()), &r)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "no recorded state", nil
+	}
+
+	if reason := compareHashRecords(&r, current, names(deps)); reason != "" {
+		return reason, nil
+	}
+
+	result, err := hashFile(ft.Path())
+	if err != nil {
+		return "", err
+	}
+	if result == "" {
+		return reasonMissing, nil
+	}
+
+	if r.Result != result {
+		return fmt.Sprintf("target changed (%s -> %s)", shortHash(r.Result), shortHash(result)), nil
+	}
+
+	c.memoize(ft, r.Result)
+	return "", nil
+}
+
+// Record implements the Checker interface.
+func (c *hashChecker) Record(t Target, deps []Target) error {
+	ft, ok := t.(FileTarget)
+	if !ok || ft.RuleFile() == "" {
+		return nil
+	}
+
+	r, err := c.inputs(ft, deps)
+	if err != nil {
+		return err
+	}
+
+	r.Result, err = hashFile(ft.Path())
+	if err != nil {
+		return err
+	}
+	if r.Result == "" {
+		r.Result = r.hash()
+	}
+
+	c.memoize(ft, r.Result)
+	return c.state.write(hashRecordKind, stateKey(ft.Path()), r)
+}
+
+// inputs returns a hashRecord with the current hashes of the targets Walkfile
+// and dependencies.
+func (c *hashChecker) inputs(t FileTarget, deps []Target) (*hashRecord, error) {
+	walkfile, err := hashFile(t.RuleFile())
+	if err != nil {
+		return nil, err
+	}
+
+	r := &hashRecord{
+		Walkfile: walkfile,
+		Deps:     make(map[string]string),
+		Env:      envHash(t),
+	}
+	for _, d := range deps {
+		dep, ok := d.(FileTarget)
+		if !ok {
+			continue
+		}
+		h, err := c.result(dep)
+		if err != nil {
+			return nil, err
+		}
+		r.Deps[dep.Path()] = h
+	}
+	return r, nil
+}
+
+// result returns the result hash of the target. Since targets are always
+// executed after their dependencies, the result hash of built targets will
+// have been recorded by the time it's needed.
+func (c *hashChecker) result(t FileTarget) (string, error) {
+	c.mu.Lock()
+	h, ok := c.results[t.Path()]
+	c.mu.Unlock()
+	if ok {
+		return h, nil
+	}
+
+	if t.RuleFile() != "" {
+		var r hashRecord
+		if _, err := c.state.read(hashRecordKind, stateKey(t.Path()), &r); err != nil {
+			return "", err
+		}
+		h = r.Result
+	} else {
+		var err error
+		if h, err = hashFile(t.Path()); err != nil {
+			return "", err
+		}
+	}
+
+	c.memoize(t, h)
+	return h, nil
+}
+
+func (c *hashChecker) memoize(t FileTarget, h string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results[t.Path()] = h
+}
+
+// hash returns a hash of the Walkfile and dependency hashes in the record.
+func (r *hashRecord) hash() string {
+	lines := []string{r.Walkfile}
+	for path, h := range r.Deps {
+		lines = append(lines, fmt.Sprintf("%s %s", h, path))
+	}
+	sort.Strings(lines[1:])
+	if r.Env != "" {
+		lines = append(lines, fmt.Sprintf("env %s", r.Env))
+	}
+	return hashBytes([]byte(strings.Join(lines, "\n")))
+}
+
+// compareHashRecords returns the reason why the current inputs differ from
+// what was previously recorded, or an empty string if they're the same. names
+// maps the path of each current dependency to its name.
+func compareHashRecords(recorded, current *hashRecord, names map[string]string) string {
+	if recorded.Walkfile != current.Walkfile {
+		return fmt.Sprintf("Walkfile changed (%s -> %s)", shortHash(recorded.Walkfile), shortHash(current.Walkfile))
+	}
+	if recorded.Env != current.Env {
+		return "environment changed"
+	}
+
+	var paths []string
+	for path := range current.Deps {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		h, ok := recorded.Deps[path]
+		if !ok {
+			return fmt.Sprintf("dependency %s added", names[path])
+		}
+		if h != current.Deps[path] {
+			return fmt.Sprintf("dependency %s changed (%s -> %s)", names[path], shortHash(h), shortHash(current.Deps[path]))
+		}
+	}
+
+	paths = nil
+	for path := range recorded.Deps {
+		if _, ok := current.Deps[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) > 0 {
+		sort.Strings(paths)
+		return fmt.Sprintf("dependency %s removed", paths[0])
+	}
+
+	return ""
+}
+
+// names maps the path of each of the given targets to its name.
+func names(targets []Target) map[string]string {
+	m := make(map[string]string)
+	for _, t := range targets {
+		if ft, ok := t.(FileTarget); ok {
+			m[ft.Path()] = ft.Name()
+		}
+	}
+	return m
+}
+
+// shortHash abbreviates a hash for display.
+func shortHash(h string) string {
+	if h == "" {
+		return "none"
+	}
+	if len(h) > 12 {
+		return h[:12]
+	}
+	return h
+}
+
+// mtimeChecker is a Checker implementation that mimics make(1). A target is
+// executed if the file it produces does not exist, or if it's older than any
+// of its dependencies.
+//
+// Dependencies that don't exist on disk (e.g. tasks like "bundled") don't
+// have a modification time, so the target is only executed if they were
+// executed in this run.
+type mtimeChecker struct {
+	mu sync.Mutex
+	// The names of the targets that were executed in this run.
+	executed map[string]bool
+}
+
+// Check implements the Checker interface.
+func (c *mtimeChecker) Check(t Target, deps []Target) (string, error) {
+	ft, ok := t.(FileTarget)
+	if !ok {
+		return "not a file", nil
+	}
+
+	// Static files are never executed.
+	if ft.RuleFile() == "" {
+		return "", nil
+	}
+
+	fi, err := os.Stat(ft.Path())
+	if os.IsNotExist(err) {
+		return reasonMissing, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	for _, d := range deps {
+		dep, ok := d.(FileTarget)
+		if !ok {
+			continue
+		}
+		depfi, err := os.Stat(dep.Path())
+		if os.IsNotExist(err) {
+			if c.wasExecuted(dep) {
+				return fmt.Sprintf("dependency %s was executed", dep.Name()), nil
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if depfi.ModTime().After(fi.ModTime()) {
+			return fmt.Sprintf("dependency %s is newer (%s > %s)", dep.Name(), formatTime(depfi.ModTime()), formatTime(fi.ModTime())), nil
+		}
+	}
+
+	return "", nil
+}
+
+// formatTime formats a modification time for display.
+func formatTime(t time.Time) string {
+	return t.Format("2006-01-02 15:04:05.000")
+}
+
+// Record implements the Checker interface. Modification times are tracked by
+// the filesystem, so only the targets that were executed are recorded, for
+// targets that depend on tasks.
+func (c *mtimeChecker) Record(t Target, deps []Target) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.executed == nil {
+		c.executed = make(map[string]bool)
+	}
+	c.executed[t.Name()] = true
+	return nil
+}
+
+func (c *mtimeChecker) wasExecuted(t Target) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.executed[t.Name()]
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// watchDebounce is how long to wait for more files to change, after a file
+// changes, so that a batch of changes (e.g. checking out a branch) only
+// executes the targets once.
+var watchDebounce = 100 * time.Millisecond
+
+// watcher reports changes to a set of files.
+type watcher interface {
+	// watch replaces the set of files that are watched.
+	watch(paths []string) error
+
+	// changes receives the path to each file that changes.
+	changes() <-chan string
+
+	Close() error
+}
+
+// Watch plans and executes the targets, and then waits for the files that
+// they depend on (the leaves of the graph, and Walkfiles) to change, until ctx
+// is done. When files change, only the targets whose Walkfile changed are
+// planned again, and only the targets that depend on the files that changed
+// are executed again.
+//
+// newPlan returns a Plan that's configured to execute targets, which is called
+// each time that the targets are planned. Errors after the targets have been
+// planned for the first time are written to w, instead of being returned,
+// along with a message each time that it starts waiting for changes.
+func Watch(ctx context.Context, w io.Writer, newPlan func() *Plan, semaphore Semaphore, targets ...string) error {
+	watcher, err := newWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	var (
+		// The last plan that was successfully planned.
+		plan *Plan
+
+		// The files that changed since plan was executed.
+		changed = make(map[string]bool)
+
+		// The targets that weren't executed successfully last time.
+		pending map[string]bool
+	)
+	for {
+		next, err := replan(ctx, newPlan, plan, changed, targets)
+		if err == nil {
+			err = watcher.watch(watchedFiles(next.graph))
+		}
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case err != nil && plan == nil:
+			return err
+		case err != nil:
+			fmt.Fprintf(w, "%s\n", ansi("31", "error: %v", err))
+		default:
+			next.only = dirty(next, plan, changed, pending)
+			changed = make(map[string]bool)
+			err := execWatched(ctx, next, semaphore, watcher, changed)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				fmt.Fprintf(w, "%s\n", ansi("31", "error: %v", err))
+			}
+			plan, pending = next, unfinished(next.only, err)
+		}
+
+		if plan != nil {
+			n := len(watchedFiles(plan.graph))
+			fmt.Fprintf(w, "watching %d %s for changes\n", n, pluralize(n, "file", "files"))
+		}
+
+		if err := waitForChanges(ctx, watcher, changed); err != nil {
+			return nil
+		}
+	}
+}
+
+// execWatched executes the plan, while adding the files that change to
+// changed. Leaves can be produced by their own exec phase, so changes to the
+// leaves that were executed are ignored if the file is still the way that
+// their exec phase left it, or they'd be executed forever.
+func execWatched(ctx context.Context, p *Plan, semaphore Semaphore, w watcher, changed map[string]bool) error {
+	// Maps the path to each leaf that was executed to its stamp after it
+	// was.
+	var mu sync.Mutex
+	stamps := make(map[string]fileStamp)
+	p.executed = func(t Target) {
+		if !isLeaf(p.graph, t) {
+			return
+		}
+		path := t.(FileTarget).Path()
+		mu.Lock()
+		defer mu.Unlock()
+		stamps[path] = stampFile(path)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case path := <-w.changes():
+				changed[path] = true
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	err := p.Exec(ctx, semaphore)
+	close(stop)
+	<-done
+
+	for path, stamp := range stamps {
+		if changed[path] && stampFile(path) == stamp {
+			delete(changed, path)
+		}
+	}
+	return err
+}
+
+// replan plans the targets again, after the files in changed have changed.
+// The targets from the previous plan, and their dependencies, are reused,
+// unless their Walkfile, or one of the inputs that it declared, changed.
+func replan(ctx context.Context, newPlan func() *Plan, previous *Plan, changed map[string]bool, targets []string) (*Plan, error) {
+	p := newPlan()
+	if previous != nil {
+		p.previous = previous.graph
+		p.stale = stale(previous.graph, changed)
+	}
+	err := p.Plan(ctx, targets...)
+	p.previous, p.stale = nil, nil
+	return p, err
+}
+
+// stale returns the names of the targets whose Walkfile, or one of the inputs
+// that it declared, changed.
+func stale(g *Graph, changed map[string]bool) map[string]bool {
+	stale := make(map[string]bool)
+	for _, t := range g.Sorted() {
+		ft, ok := t.(FileTarget)
+		if !ok || ft.RuleFile() == "" {
+			continue
+		}
+		if changed[ft.RuleFile()] {
+			stale[t.Name()] = true
+		}
+		for _, path := range declared(t).inputs {
+			if changed[path] {
+				stale[t.Name()] = true
+			}
+		}
+	}
+	return stale
+}
+
+// dirty returns the names of the targets that need to be executed: targets
+// that weren't in the previous plan, were planned again, are leaves whose file
+// changed, or weren't executed successfully last time, along with every target
+// that depends on them. If there's no previous plan, every target is
+// dirty.
+func dirty(p, previous *Plan, changed, pending map[string]bool) map[string]bool {
+	dirty := make(map[string]bool)
+	for _, t := range p.graph.Sorted() {
+		name := t.Name()
+		switch {
+		case previous == nil, pending[name], previous.graph.Target(name) != t:
+			dirty[name] = true
+		case isLeaf(p.graph, t) && changed[t.(FileTarget).Path()]:
+			dirty[name] = true
+		default:
+			for _, dep := range p.graph.Dependencies(t) {
+				if dirty[dep.Name()] {
+					dirty[name] = true
+					break
+				}
+			}
+		}
+	}
+	return dirty
+}
+
+// unfinished returns the names of the targets that were supposed to be
+// executed, but failed, or weren't executed because of err.
+func unfinished(executed map[string]bool, err error) map[string]bool {
+	if err == nil {
+		return nil
+	}
+	var werr *WalkError
+	if !errors.As(err, &werr) {
+		return executed
+	}
+
+	unfinished := make(map[string]bool)
+	for name := range werr.Errors {
+		unfinished[name] = true
+	}
+	for name := range werr.Cancelled {
+		unfinished[name] = true
+	}
+	for name := range werr.Skipped {
+		unfinished[name] = true
+	}
+	return unfinished
+}
+
+// watchedFiles returns the files that the targets in the graph depend on:
+// the files of the leaves, Walkfiles, and the inputs that Walkfiles declared.
+func watchedFiles(g *Graph) []string {
+	seen := make(map[string]bool)
+	for _, t := range g.Sorted() {
+		ft, ok := t.(FileTarget)
+		if !ok {
+			continue
+		}
+		if isLeaf(g, t) {
+			seen[ft.Path()] = true
+		}
+		if ft.RuleFile() != "" {
+			seen[ft.RuleFile()] = true
+		}
+		for _, path := range declared(t).inputs {
+			seen[path] = true
+		}
+	}
+
+	var paths []string
+	for path := range seen {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// isLeaf returns true if the target is a file that doesn't depend on any
+// other targets, like a source file.
+func isLeaf(g *Graph, t Target) bool {
+	_, ok := t.(FileTarget)
+	return ok && len(g.Dependencies(t)) == 0
+}
+
+// fileStamp is the state of a file that's checked for changes.
+type fileStamp struct {
+	exists bool
+	mtime  int64
+	size   int64
+}
+
+func stampFile(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{exists: true, mtime: info.ModTime().UnixNano(), size: info.Size()}
+}
+
+// waitForChanges waits for at least one file to change, and then until no
+// more files have changed for watchDebounce, adding them to changed.
+func waitForChanges(ctx context.Context, w watcher, changed map[string]bool) error {
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case path := <-w.changes():
+			changed[path] = true
+			debounce = time.After(watchDebounce)
+		case <-debounce:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,220 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// The inotify events that indicate that a file in a watched directory changed.
+// Directories are watched, rather than the files themselves, so that files
+// that are replaced by renaming another file over them (e.g. by editors) are
+// still watched.
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+
+// inotifyWatcher is a watcher that uses inotify(7).
+type inotifyWatcher struct {
+	fd   int
+	f    *os.File
+	c    chan string
+	done chan struct{}
+
+	mu sync.Mutex
+
+	// Maps each watch descriptor to the directory that it watches, and
+	// back.
+	dirs map[int]string
+	wds  map[string]int
+
+	// The files that are watched.
+	files map[string]bool
+}
+
+func newWatcher() (watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	w := &inotifyWatcher{
+		fd:    fd,
+		f:     os.NewFile(uintptr(fd), "inotify"),
+		c:     make(chan string),
+		done:  make(chan struct{}),
+		dirs:  make(map[int]string),
+		wds:   make(map[string]int),
+		files: make(map[string]bool),
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *inotifyWatcher) watch(paths []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.files = make(map[string]bool)
+	for _, path := range paths {
+		w.files[path] = true
+	}
+	_, err := w.update()
+	return err
+}
+
+// update watches the directory of each file, or the nearest ancestor of it
+// that exists, until it's created, and stops watching the rest. It returns the
+// files that already exist in the directories that weren't watched before,
+// since they may have been created before the directory was watched. Must be
+// called with mu held.
+func (w *inotifyWatcher) update() ([]string, error) {
+	parents := make(map[string]bool)
+	for path := range w.files {
+		parents[filepath.Dir(path)] = true
+	}
+	dirs := make(map[string]bool)
+	for dir := range parents {
+		dirs[existingAncestor(dir)] = true
+	}
+
+	for dir, wd := range w.wds {
+		if !dirs[dir] {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.wds, dir)
+			delete(w.dirs, wd)
+		}
+	}
+
+	added := make(map[string]bool)
+	for dir := range dirs {
+		if _, ok := w.wds[dir]; ok {
+			continue
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+		// The directory was removed since it was found, or isn't a
+		// directory, so the file can't exist.
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ENOTDIR) {
+			continue
+		}
+		if err != nil {
+			return nil, os.NewSyscallError("inotify_add_watch", err)
+		}
+		w.wds[dir] = wd
+		w.dirs[wd] = dir
+		added[dir] = true
+	}
+
+	var created []string
+	for path := range w.files {
+		if !added[filepath.Dir(path)] {
+			continue
+		}
+		if _, err := os.Stat(path); err == nil {
+			created = append(created, path)
+		}
+	}
+	return created, nil
+}
+
+// existingAncestor returns dir if it exists, otherwise the nearest ancestor of
+// it that does.
+func existingAncestor(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+func (w *inotifyWatcher) changes() <-chan string {
+	return w.c
+}
+
+// read reads events until the watcher is closed, and sends the paths to the
+// watched files that they're for.
+func (w *inotifyWatcher) read() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			return
+		}
+
+		var changed []string
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := string(buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)])
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			changed = append(changed, w.event(ev, strings.TrimRight(name, "\x00"))...)
+		}
+
+		for _, path := range changed {
+			select {
+			case w.c <- path:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+// event returns the paths to the watched files that changed, according to
+// the event.
+func (w *inotifyWatcher) event(ev *syscall.InotifyEvent, name string) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Events were dropped, so any file may have changed.
+	if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+		var paths []string
+		for path := range w.files {
+			paths = append(paths, path)
+		}
+		return paths
+	}
+
+	dir, ok := w.dirs[int(ev.Wd)]
+	if !ok {
+		return nil
+	}
+
+	// The directory was removed, so its nearest ancestor that exists is
+	// watched instead, until it's created again. Errors are ignored, since
+	// there's nothing to report them to, and the files can't change until
+	// their directory is created again anyway.
+	if ev.Mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, int(ev.Wd))
+		delete(w.wds, dir)
+		created, _ := w.update()
+		return created
+	}
+
+	// A directory was created, which may be, or contain, the directory of
+	// a file that's watched through its ancestor.
+	var changed []string
+	if ev.Mask&syscall.IN_ISDIR != 0 {
+		changed, _ = w.update()
+	}
+
+	path := filepath.Join(dir, name)
+	if w.files[path] {
+		changed = append(changed, path)
+	}
+	return changed
+}
+
+func (w *inotifyWatcher) Close() error {
+	close(w.done)
+	return w.f.Close()
+}
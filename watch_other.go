@@ -0,0 +1,91 @@
+//go:build !linux
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// watchPollInterval is how often files are checked for changes, on platforms
+// without inotify.
+var watchPollInterval = 500 * time.Millisecond
+
+// pollWatcher is a watcher that periodically checks the modification time and
+// size of each file.
+type pollWatcher struct {
+	c    chan string
+	done chan struct{}
+
+	mu sync.Mutex
+
+	// Maps each file that's watched to its state when it was last checked.
+	files map[string]fileStamp
+}
+
+func newWatcher() (watcher, error) {
+	w := &pollWatcher{
+		c:     make(chan string),
+		done:  make(chan struct{}),
+		files: make(map[string]fileStamp),
+	}
+	go w.poll()
+	return w, nil
+}
+
+func (w *pollWatcher) watch(paths []string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	files := make(map[string]fileStamp)
+	for _, path := range paths {
+		if stamp, ok := w.files[path]; ok {
+			files[path] = stamp
+		} else {
+			files[path] = stampFile(path)
+		}
+	}
+	w.files = files
+	return nil
+}
+
+func (w *pollWatcher) changes() <-chan string {
+	return w.c
+}
+
+// poll checks the files for changes until the watcher is closed.
+func (w *pollWatcher) poll() {
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.done:
+			return
+		}
+
+		var changed []string
+		w.mu.Lock()
+		for path, stamp := range w.files {
+			if now := stampFile(path); now != stamp {
+				w.files[path] = now
+				changed = append(changed, path)
+			}
+		}
+		w.mu.Unlock()
+
+		for _, path := range changed {
+			select {
+			case w.c <- path:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+func (w *pollWatcher) Close() error {
+	close(w.done)
+	return nil
+}
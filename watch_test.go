@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	walkfile := `#!/bin/bash
+echo "$1 $2" >> log
+case $2 in
+  all)
+    case $1 in
+      deps) echo a.out; echo b.out ;;
+    esac ;;
+  a.out)
+    case $1 in
+      deps) echo a.txt ;;
+      exec) cp a.txt a.out ;;
+    esac ;;
+  b.out)
+    case $1 in
+      deps) echo b.txt ;;
+      exec) cp b.txt b.out ;;
+    esac ;;
+esac
+`
+	writeFile(t, filepath.Join(dir, "Walkfile"), walkfile)
+	writeFile(t, filepath.Join(dir, "a.txt"), "a")
+	writeFile(t, filepath.Join(dir, "b.txt"), "b")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	out := new(syncBuffer)
+	newTarget := NewTarget(TargetOptions{
+		WorkingDir: dir,
+		Stdout:     out,
+	})
+	newPlan := func() *Plan {
+		plan := newPlan()
+		plan.NewTarget = newTarget
+		return plan
+	}
+
+	r, w := io.Pipe()
+	messages := bufio.NewScanner(r)
+	done := make(chan error)
+	go func() {
+		done <- Watch(ctx, w, newPlan, NewSemaphore(0), "all")
+		w.Close()
+	}()
+
+	// Waits until the targets have been executed, and the files are being
+	// watched.
+	waitForWatch := func() {
+		assert.True(t, messages.Scan())
+		assert.Equal(t, "watching 3 files for changes", messages.Text())
+	}
+
+	// Returns the lines in the log, sorted, since targets are planned and
+	// executed concurrently.
+	readLog := func() []string {
+		raw, _ := os.ReadFile(filepath.Join(dir, "log"))
+		os.Remove(filepath.Join(dir, "log"))
+		lines := strings.Fields(strings.ReplaceAll(string(raw), " ", ":"))
+		sort.Strings(lines)
+		return lines
+	}
+
+	everything := []string{
+		"deps:a.out", "deps:a.txt", "deps:all", "deps:b.out", "deps:b.txt",
+		"exec:a.out", "exec:a.txt", "exec:all", "exec:b.out", "exec:b.txt",
+	}
+
+	// Everything is planned and executed first.
+	waitForWatch()
+	assert.Equal(t, everything, readLog())
+
+	// Only the targets that depend on the file that changed are executed,
+	// without planning them again.
+	writeFile(t, filepath.Join(dir, "a.txt"), "aa")
+	waitForWatch()
+	assert.Equal(t, []string{"exec:a.out", "exec:a.txt", "exec:all"}, readLog())
+
+	raw, err := os.ReadFile(filepath.Join(dir, "a.out"))
+	assert.NoError(t, err)
+	assert.Equal(t, "aa", string(raw))
+
+	// The targets that use a Walkfile that changed are planned again.
+	writeFile(t, filepath.Join(dir, "Walkfile"), walkfile+"# changed\n")
+	waitForWatch()
+	assert.Equal(t, everything, readLog())
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestWatcher_MissingDirectory(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a", "b", "c.txt")
+
+	w, err := newWatcher()
+	assert.NoError(t, err)
+	defer w.Close()
+
+	// The file is watched through the nearest directory that exists, until
+	// its own is created.
+	err = w.watch([]string{path})
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	writeFile(t, path, "c")
+
+	select {
+	case changed := <-w.changes():
+		assert.Equal(t, path, changed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the file to change")
+	}
+}